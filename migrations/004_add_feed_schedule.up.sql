@@ -0,0 +1,11 @@
+-- Per-feed scheduling state for the background refresher
+ALTER TABLE feeds ADD COLUMN next_fetch_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Current polling interval, in seconds
+ALTER TABLE feeds ADD COLUMN fetch_interval INTEGER NOT NULL DEFAULT 3600;
+
+-- Observed number of new items per day
+ALTER TABLE feeds ADD COLUMN item_rate DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+-- Create index for finding feeds that are due for a fetch
+CREATE INDEX idx_feeds_next_fetch_at ON feeds(next_fetch_at);
@@ -0,0 +1,3 @@
+-- HTTP validators from the last successful fetch, for conditional GET
+ALTER TABLE feeds ADD COLUMN etag TEXT NOT NULL DEFAULT '';
+ALTER TABLE feeds ADD COLUMN last_modified TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,21 @@
+-- Outcome of the most recent fetches, so broken feeds don't go unnoticed
+ALTER TABLE feeds ADD COLUMN last_attempt_at TIMESTAMPTZ;
+ALTER TABLE feeds ADD COLUMN last_success_at TIMESTAMPTZ;
+ALTER TABLE feeds ADD COLUMN last_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE feeds ADD COLUMN last_items_added INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN consecutive_failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feeds ADD COLUMN failing_since TIMESTAMPTZ;
+
+-- Create feed_fetches table for the recent fetch history of each feed
+CREATE TABLE feed_fetches (
+  id           UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  feed_id      UUID NOT NULL,
+  attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  status_code  INTEGER NOT NULL DEFAULT 0,
+  error        TEXT NOT NULL DEFAULT '',
+  items_added  INTEGER NOT NULL DEFAULT 0,
+  CONSTRAINT fk_feed FOREIGN KEY (feed_id) REFERENCES feeds (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_feed_fetches_feed_id ON feed_fetches(feed_id, attempted_at DESC);
@@ -0,0 +1,3 @@
+-- Feeds that are gone for good are no longer fetched
+ALTER TABLE feeds ADD COLUMN dead_at TIMESTAMPTZ;
+ALTER TABLE feeds ADD COLUMN dead_reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- Remove duplicate subscriptions before enforcing uniqueness
+DELETE FROM user_feeds a
+USING user_feeds b
+WHERE a.ctid < b.ctid
+  AND a.user_id = b.user_id
+  AND a.feed_id = b.feed_id;
+
+ALTER TABLE user_feeds ADD CONSTRAINT unique_user_feed UNIQUE (user_id, feed_id);
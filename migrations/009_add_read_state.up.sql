@@ -0,0 +1,11 @@
+-- Create user_item_reads table for per-user read state of feed items
+CREATE TABLE user_item_reads (
+  user_id    UUID NOT NULL,
+  content_id UUID NOT NULL,
+  read_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT pk_user_item_reads PRIMARY KEY (user_id, content_id),
+  CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+  CONSTRAINT fk_content FOREIGN KEY (content_id) REFERENCES feed_content (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_feed_content_feed_id ON feed_content(feed_id);
@@ -0,0 +1,21 @@
+-- Create starred_items table. Starred items keep a copy of everything needed
+-- to render them, so they survive their feed_content row or feed going away.
+CREATE TABLE starred_items (
+  id           UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id      UUID NOT NULL,
+  content_id   UUID,
+  feed_id      UUID,
+  "guid"       TEXT NOT NULL,
+  title        TEXT NOT NULL,
+  "link"       TEXT NOT NULL,
+  img_url      TEXT NOT NULL DEFAULT '',
+  feed_title   TEXT NOT NULL,
+  published_at TIMESTAMPTZ NOT NULL,
+  starred_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+  CONSTRAINT fk_content FOREIGN KEY (content_id) REFERENCES feed_content (id) ON DELETE SET NULL,
+  CONSTRAINT fk_feed FOREIGN KEY (feed_id) REFERENCES feeds (id) ON DELETE SET NULL,
+  CONSTRAINT unique_user_starred_guid UNIQUE (user_id, "guid")
+);
+
+CREATE INDEX idx_starred_items_user_id ON starred_items(user_id, starred_at DESC);
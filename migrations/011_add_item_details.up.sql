@@ -0,0 +1,6 @@
+-- Keep everything the feed tells us about an item
+ALTER TABLE feed_content ADD COLUMN summary TEXT NOT NULL DEFAULT '';
+ALTER TABLE feed_content ADD COLUMN content TEXT NOT NULL DEFAULT '';
+ALTER TABLE feed_content ADD COLUMN author TEXT NOT NULL DEFAULT '';
+ALTER TABLE feed_content ADD COLUMN categories TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE feed_content ADD COLUMN updated_at TIMESTAMPTZ;
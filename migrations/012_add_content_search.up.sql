@@ -0,0 +1,8 @@
+-- Full-text search over item titles, summaries and content
+ALTER TABLE feed_content ADD COLUMN search_vector TSVECTOR GENERATED ALWAYS AS (
+  setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+  setweight(to_tsvector('english', COALESCE(summary, '')), 'B') ||
+  setweight(to_tsvector('english', COALESCE(content, '')), 'C')
+) STORED;
+
+CREATE INDEX idx_feed_content_search ON feed_content USING GIN (search_vector);
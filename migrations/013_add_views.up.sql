@@ -0,0 +1,12 @@
+-- Saved queries that work as timelines of their own
+CREATE TABLE views (
+  id         UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id    UUID NOT NULL,
+  name       CITEXT NOT NULL,
+  query      TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id),
+  CONSTRAINT unique_user_view_name UNIQUE (user_id, name)
+);
+
+CREATE INDEX idx_views_user_id ON views(user_id);
@@ -0,0 +1,13 @@
+-- Tags can be nested under other tags, e.g. tech/go
+ALTER TABLE tags ADD COLUMN parent_id UUID;
+ALTER TABLE tags ADD CONSTRAINT fk_parent FOREIGN KEY (parent_id) REFERENCES tags (id);
+
+CREATE INDEX idx_tags_parent_id ON tags(parent_id);
+
+-- Names only need to be unique among siblings
+ALTER TABLE tags DROP CONSTRAINT unique_user_tag_name;
+CREATE UNIQUE INDEX unique_user_tag_name ON tags (
+  user_id,
+  COALESCE(parent_id, '00000000-0000-0000-0000-000000000000'),
+  name
+);
@@ -0,0 +1,7 @@
+-- Tags get a color and a custom order among their siblings
+ALTER TABLE tags ADD COLUMN color TEXT NOT NULL DEFAULT '';
+ALTER TABLE tags ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+
+-- Deleting a tag detaches it from its feeds
+ALTER TABLE feed_tags DROP CONSTRAINT fk_tag;
+ALTER TABLE feed_tags ADD CONSTRAINT fk_tag FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE;
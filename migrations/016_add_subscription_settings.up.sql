@@ -0,0 +1,8 @@
+-- Subscriptions get their own id and per-user settings
+ALTER TABLE user_feeds ADD COLUMN id UUID NOT NULL DEFAULT uuid_generate_v4();
+ALTER TABLE user_feeds ADD CONSTRAINT user_feeds_pkey PRIMARY KEY (id);
+
+ALTER TABLE user_feeds ADD COLUMN custom_title  TEXT NOT NULL DEFAULT '';
+ALTER TABLE user_feeds ADD COLUMN paused        BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_feeds ADD COLUMN subscribed_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE user_feeds ADD COLUMN note          TEXT NOT NULL DEFAULT '';
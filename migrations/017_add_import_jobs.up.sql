@@ -0,0 +1,30 @@
+-- OPML imports run in the background and report on every feed outline
+CREATE TABLE import_jobs (
+  id          UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id     UUID NOT NULL,
+  status      TEXT NOT NULL DEFAULT 'pending',
+  total       INTEGER NOT NULL DEFAULT 0,
+  processed   INTEGER NOT NULL DEFAULT 0,
+  added       INTEGER NOT NULL DEFAULT 0,
+  existing    INTEGER NOT NULL DEFAULT 0,
+  failed      INTEGER NOT NULL DEFAULT 0,
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  finished_at TIMESTAMPTZ,
+  CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX idx_import_jobs_user_id ON import_jobs(user_id, created_at DESC);
+
+CREATE TABLE import_items (
+  id      UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  job_id  UUID NOT NULL,
+  line    INTEGER NOT NULL,
+  url     TEXT NOT NULL,
+  title   TEXT NOT NULL DEFAULT '',
+  tags    JSONB NOT NULL DEFAULT '[]',
+  status  TEXT NOT NULL DEFAULT 'pending',
+  error   TEXT NOT NULL DEFAULT '',
+  CONSTRAINT fk_job FOREIGN KEY (job_id) REFERENCES import_jobs (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_import_items_job_id ON import_items(job_id, line);
@@ -0,0 +1,2 @@
+-- The web site a feed belongs to, as given by the feed itself
+ALTER TABLE feeds ADD COLUMN site_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- Secret token in the URLs of a user's output feeds, so other readers can
+-- fetch them without a session
+ALTER TABLE users ADD COLUMN feed_token TEXT NOT NULL
+  DEFAULT replace(uuid_generate_v4()::text || uuid_generate_v4()::text, '-', '');
+
+CREATE UNIQUE INDEX idx_users_feed_token ON users(feed_token);
@@ -0,0 +1,13 @@
+-- Named API tokens for scripts and other non-browser clients. The token
+-- itself is a JWT naming the row's id; deleting the row revokes it.
+CREATE TABLE api_tokens (
+  id           UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id      UUID NOT NULL,
+  name         CITEXT NOT NULL,
+  read_only    BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMPTZ,
+  CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX idx_api_tokens_user_id ON api_tokens(user_id);
@@ -0,0 +1,2 @@
+-- Why an import stopped before going through all of its feeds
+ALTER TABLE import_jobs ADD COLUMN error TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"rss-simple/src/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// jsonError answers an API request with a status code and an error message.
+func jsonError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// apiServiceError answers an API request with the status code that fits an
+// error returned by a service: missing rows are 404, duplicates 409 and
+// malformed ids 400. Anything else is logged and reported as a 500.
+func apiServiceError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return jsonError(c, fiber.StatusNotFound, "not found")
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505":
+			return jsonError(c, fiber.StatusConflict, "already exists")
+		case "22P02":
+			return jsonError(c, fiber.StatusBadRequest, "malformed id")
+		}
+	}
+
+	fmt.Println(err)
+	return jsonError(c, fiber.StatusInternalServerError, "internal error")
+}
+
+// readOPML parses the OPML document uploaded as the file "opml", or sent as
+// the request body itself.
+func readOPML(c *fiber.Ctx) ([]services.OPMLFeed, error) {
+	upload, err := c.FormFile("opml")
+	if err != nil {
+		if len(c.Body()) == 0 || strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+			return nil, errors.New("choose an OPML file to import")
+		}
+		return services.ParseOPML(bytes.NewReader(c.Body()))
+	}
+
+	file, err := upload.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return services.ParseOPML(file)
+}
+
+// apiAuth lets API requests through for logged in users and for requests
+// with an API token in an Authorization: Bearer header, which tokenAuth
+// checks. Anything else is answered with 401 instead of a redirect to the
+// login page.
+func apiAuth(store *session.Store, tokenAuth fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get(fiber.HeaderAuthorization) != "" {
+			if tokenAuth == nil {
+				return jsonError(c, fiber.StatusUnauthorized, "API tokens are not enabled on this server")
+			}
+			return tokenAuth(c)
+		}
+
+		sess, err := store.Get(c)
+		if err != nil {
+			return jsonError(c, fiber.StatusUnauthorized, "not logged in")
+		}
+
+		userID := sess.Get("user_id")
+		if userID == nil {
+			return jsonError(c, fiber.StatusUnauthorized, "not logged in")
+		}
+
+		c.Locals("user_id", userID)
+
+		return c.Next()
+	}
+}
+
+// tokenAuth verifies the JWT of an API token signed with secret, checks that
+// the token hasn't been revoked and keeps read-only tokens to reading.
+func tokenAuth(db *sqlx.DB, secret []byte) fiber.Handler {
+	return jwtware.New(jwtware.Config{
+		SigningKey: secret,
+		Claims:     &jwt.RegisteredClaims{},
+		ContextKey: "jwt",
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return jsonError(c, fiber.StatusUnauthorized, "invalid API token")
+		},
+		SuccessHandler: func(c *fiber.Ctx) error {
+			claims := c.Locals("jwt").(*jwt.Token).Claims.(*jwt.RegisteredClaims)
+
+			token, err := services.UseApiToken(db, claims.Subject, claims.ID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return jsonError(c, fiber.StatusUnauthorized, "API token has been revoked")
+			}
+			if err != nil {
+				return apiServiceError(c, err)
+			}
+
+			if token.ReadOnly && c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+				return jsonError(c, fiber.StatusForbidden, "API token is read-only")
+			}
+
+			c.Locals("user_id", token.UserId)
+
+			return c.Next()
+		},
+	})
+}
+
+type apiFeedRequest struct {
+	Url string `json:"url"`
+}
+
+// apiTagRequest changes the fields of a tag that are set and leaves the
+// others alone. A parentId of "" moves the tag to the top level.
+type apiTagRequest struct {
+	Name     *string `json:"name"`
+	Color    *string `json:"color"`
+	ParentId *string `json:"parentId"`
+}
+
+// registerAPI adds the JSON API under /api/v1. Successful requests answer
+// with the resource, errors with a status code and {"error": "..."}.
+func registerAPI(app *fiber.App, db *sqlx.DB, refresher *services.Refresher, auth fiber.Handler) {
+	api := app.Group("/api/v1", auth)
+
+	// Feeds
+	api.Get("/feeds", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feeds, err := services.GetUserFeedsWithTags(db, userID)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{"feeds": feeds})
+	})
+
+	api.Post("/feeds", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		request := apiFeedRequest{}
+		if err := c.BodyParser(&request); err != nil || request.Url == "" {
+			return jsonError(c, fiber.StatusBadRequest, "url is required")
+		}
+
+		feed, err := services.AddUserFeed(db, userID, request.Url)
+
+		var choice *services.FeedChoiceError
+		if errors.As(err, &choice) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":   choice.Error(),
+				"choices": choice.Feeds,
+			})
+		}
+		if errors.Is(err, services.ErrAlreadySubscribed) {
+			c.Location("/api/v1/feeds/" + feed.Id)
+			return jsonError(c, fiber.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return jsonError(c, fiber.StatusUnprocessableEntity, "failed to add feed: "+err.Error())
+		}
+
+		c.Location("/api/v1/feeds/" + feed.Id)
+		return c.Status(fiber.StatusCreated).JSON(feed)
+	})
+
+	api.Get("/feeds/:feedId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		subscription, err := services.GetSubscription(db, userID, feed.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		tags, err := services.GetFeedTags(db, feed.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		// Only the user's own tags
+		ownTags := []services.Tag{}
+		for _, tag := range tags {
+			if tag.UserId == userID {
+				ownTags = append(ownTags, tag)
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"feed":         feed,
+			"subscription": subscription,
+			"tags":         ownTags,
+		})
+	})
+
+	api.Delete("/feeds/:feedId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		err = services.DeleteUserFeed(db, userID, feed.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	api.Get("/feeds/:feedId/subscription", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		subscription, err := services.GetSubscription(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(subscription)
+	})
+
+	api.Put("/feeds/:feedId/subscription", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		subscription, err := services.GetSubscription(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		settings := services.SubscriptionSettings{}
+		if err := c.BodyParser(&settings); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, "invalid subscription settings")
+		}
+
+		err = services.UpdateSubscription(db, userID, subscription.FeedId, settings)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		subscription, err = services.GetSubscription(db, userID, subscription.FeedId)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(subscription)
+	})
+
+	// Tags of a feed
+	api.Put("/feeds/:feedId/tags/:tagId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		err = services.AddTagToFeed(db, feed.Id, tag.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	api.Delete("/feeds/:feedId/tags/:tagId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		err = services.RemoveTagFromFeed(db, feed.Id, tag.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Tags
+	api.Get("/tags", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		tags, err := services.GetUserTagsWithUnread(db, userID)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{"tags": tags})
+	})
+
+	api.Post("/tags", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		request := apiTagRequest{}
+		if err := c.BodyParser(&request); err != nil || request.Name == nil || strings.TrimSpace(*request.Name) == "" {
+			return jsonError(c, fiber.StatusBadRequest, "name is required")
+		}
+
+		color := ""
+		if request.Color != nil {
+			color = *request.Color
+		}
+		if err := services.ValidateTagColor(color); err != nil {
+			return jsonError(c, fiber.StatusUnprocessableEntity, err.Error())
+		}
+
+		parentId := ""
+		if request.ParentId != nil && *request.ParentId != "" {
+			parent, err := services.GetTag(db, userID, *request.ParentId)
+			if err != nil {
+				return jsonError(c, fiber.StatusUnprocessableEntity, "parent tag not found")
+			}
+			parentId = parent.Id
+		}
+
+		tag, err := services.CreateTag(db, userID, strings.TrimSpace(*request.Name), parentId)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		if color != "" {
+			err = services.UpdateTag(db, userID, tag.Id, tag.Name, color)
+			if err != nil {
+				return apiServiceError(c, err)
+			}
+		}
+
+		tag, err = services.GetTag(db, userID, tag.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		c.Location("/api/v1/tags/" + tag.Id)
+		return c.Status(fiber.StatusCreated).JSON(tag)
+	})
+
+	api.Get("/tags/:tagId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(tag)
+	})
+
+	api.Patch("/tags/:tagId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		request := apiTagRequest{}
+		if err := c.BodyParser(&request); err != nil {
+			return jsonError(c, fiber.StatusBadRequest, "invalid tag")
+		}
+
+		name, color := tag.Name, tag.Color
+		if request.Name != nil {
+			name = *request.Name
+		}
+		if request.Color != nil {
+			color = *request.Color
+		}
+
+		// Nothing changes unless all of it can
+		tx, err := db.Beginx()
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+		defer tx.Rollback()
+
+		err = services.UpdateTag(tx, userID, tag.Id, name, color)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) {
+				return apiServiceError(c, err)
+			}
+			return jsonError(c, fiber.StatusUnprocessableEntity, err.Error())
+		}
+
+		if request.ParentId != nil {
+			err = services.SetTagParent(tx, userID, tag.Id, *request.ParentId)
+			if err != nil {
+				return jsonError(c, fiber.StatusUnprocessableEntity, err.Error())
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		tag, err = services.GetTag(db, userID, tag.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(tag)
+	})
+
+	// Nested tags move up to the parent, unless ?children=delete
+	api.Delete("/tags/:tagId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		err = services.DeleteTag(db, userID, tag.Id, c.Query("children") == "delete")
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Items, filtered like /content by tag_id, tag_mode, not_tag_id,
+	// untagged and unread
+	api.Get("/items", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			return jsonError(c, fiber.StatusBadRequest, "page must be a positive number")
+		}
+
+		pageSize, err := strconv.Atoi(c.Query("page_size", "25"))
+		if err != nil || pageSize < 1 || pageSize > 100 {
+			return jsonError(c, fiber.StatusBadRequest, "page_size must be between 1 and 100")
+		}
+
+		filter := services.ContentFilter{
+			UnreadOnly: c.Query("unread") == "1",
+			Tags:       tagFilter(queryValues(c)),
+		}
+
+		items, err := services.GetContent(db, userID, page, pageSize, filter)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		total, err := services.GetContentCount(db, userID, filter)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{
+			"items":      items,
+			"page":       page,
+			"pageSize":   pageSize,
+			"total":      total,
+			"totalPages": (total + pageSize - 1) / pageSize,
+		})
+	})
+
+	api.Get("/items/:itemId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		item, err := services.GetItem(db, userID, c.Params("itemId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(item)
+	})
+
+	// Read and starred state, set with PUT and cleared with DELETE
+	itemState := func(set func(*sqlx.DB, string, string) error) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			userID := c.Locals("user_id").(string)
+
+			item, err := services.GetItem(db, userID, c.Params("itemId"))
+			if err != nil {
+				return apiServiceError(c, err)
+			}
+
+			err = set(db, userID, item.Id)
+			if err != nil {
+				return apiServiceError(c, err)
+			}
+
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+	}
+
+	api.Put("/items/:itemId/read", itemState(services.MarkItemRead))
+	api.Delete("/items/:itemId/read", itemState(services.MarkItemUnread))
+	api.Put("/items/:itemId/star", itemState(services.StarItem))
+	api.Delete("/items/:itemId/star", itemState(services.UnstarItem))
+
+	api.Post("/refresh", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		// Feeds are refreshed in the background, this only asks for it to happen sooner
+		err := services.ExpediteUserFeeds(db, userID)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+		refresher.Trigger()
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"status": "refreshing"})
+	})
+
+	// OPML imports, sent as the request body or as the file "opml"
+	api.Post("/imports", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feeds, err := readOPML(c)
+		if err != nil {
+			return jsonError(c, fiber.StatusBadRequest, "failed to read OPML: "+err.Error())
+		}
+
+		job, err := services.CreateImportJob(db, userID, feeds)
+		if err != nil {
+			return jsonError(c, fiber.StatusBadRequest, err.Error())
+		}
+
+		go func() {
+			err := services.RunImportJob(db, job.Id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+
+		c.Location("/api/v1/imports/" + job.Id)
+		return c.Status(fiber.StatusAccepted).JSON(job)
+	})
+
+	api.Get("/imports/:jobId", func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		job, err := services.GetImportJob(db, userID, c.Params("jobId"))
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		items, err := services.GetImportItems(db, job.Id)
+		if err != nil {
+			return apiServiceError(c, err)
+		}
+
+		return c.JSON(fiber.Map{
+			"job":   job,
+			"items": items,
+		})
+	})
+
+	api.Use(func(c *fiber.Ctx) error {
+		return jsonError(c, fiber.StatusNotFound, "no such endpoint")
+	})
+}
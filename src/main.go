@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"rss-simple/src/services"
@@ -17,6 +29,123 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// getDurationEnv reads a duration such as "15m" from the environment.
+func getDurationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+
+	return duration
+}
+
+func getIntEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+
+	return number
+}
+
+// redirectBack sends the user back to the page they came from on this site.
+func redirectBack(c *fiber.Ctx, fallback string) error {
+	referer, err := url.Parse(c.Get(fiber.HeaderReferer))
+	if err != nil || referer.Host != c.Hostname() || referer.Path == "" {
+		return c.Redirect(fallback)
+	}
+
+	return c.Redirect(referer.RequestURI())
+}
+
+// queryValues returns every value of the query string, including repeated
+// parameters.
+func queryValues(c *fiber.Ctx) url.Values {
+	values, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return url.Values{}
+	}
+
+	return values
+}
+
+// formValues returns every value of a url encoded form, including repeated
+// fields.
+func formValues(c *fiber.Ctx) url.Values {
+	values, err := url.ParseQuery(string(c.Body()))
+	if err != nil {
+		return url.Values{}
+	}
+
+	return values
+}
+
+// pageQuery returns the current query string without the page number, so
+// that pagination links keep every other filter.
+func pageQuery(c *fiber.Ctx) template.URL {
+	values := queryValues(c)
+	values.Del("page")
+
+	return template.URL(values.Encode())
+}
+
+// tagFilter reads a combination of tags: any number of tag_id ("*" being
+// every feed), tag_mode=all to require every one of them, any number of
+// not_tag_id and untagged=1.
+func tagFilter(values url.Values) services.TagFilter {
+	filter := services.TagFilter{
+		Include:  []string{},
+		MatchAll: values.Get("tag_mode") == "all",
+		Exclude:  []string{},
+		Untagged: values.Get("untagged") == "1",
+	}
+
+	for _, tagId := range values["tag_id"] {
+		if tagId != "" && tagId != "*" {
+			filter.Include = append(filter.Include, tagId)
+		}
+	}
+
+	for _, tagId := range values["not_tag_id"] {
+		if tagId != "" {
+			filter.Exclude = append(filter.Exclude, tagId)
+		}
+	}
+
+	return filter
+}
+
+// notModified tells whether the client already has the response with this
+// ETag and Last-Modified date, going by its conditional request headers.
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, candidate := range strings.Split(noneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	modifiedSince, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+
+	return !lastModified.Truncate(time.Second).After(modifiedSince)
+}
+
 func main() {
 	connStr := os.Getenv("DATABASE_URL")
 	port := os.Getenv("PORT")
@@ -26,9 +155,44 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Feeds added before URLs were normalized may exist more than once
+	err = services.MergeDuplicateFeeds(db)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// Refresh feeds in the background, each on its own adaptive schedule
+	refreshInterval := getDurationEnv("REFRESH_INTERVAL", time.Minute)
+	if refreshInterval <= 0 {
+		log.Fatalf("invalid REFRESH_INTERVAL: %s must be greater than zero", refreshInterval)
+	}
+
+	// Number of items in the feeds served under /output
+	outputFeedSize := getIntEnv("OUTPUT_FEED_SIZE", 50)
+	if outputFeedSize <= 0 {
+		log.Fatalf("invalid OUTPUT_FEED_SIZE: %d must be greater than zero", outputFeedSize)
+	}
+
+	refresher := services.NewRefresher(db, services.RefresherConfig{
+		Interval:     refreshInterval,
+		MinInterval:  getDurationEnv("FEED_MIN_INTERVAL", 15*time.Minute),
+		MaxInterval:  getDurationEnv("FEED_MAX_INTERVAL", 24*time.Hour),
+		Concurrency:  getIntEnv("REFRESH_CONCURRENCY", 16),
+		FetchTimeout: getDurationEnv("FETCH_TIMEOUT", 30*time.Second),
+		MaxBackoff:   getDurationEnv("FEED_MAX_BACKOFF", 24*time.Hour),
+		DeadAfter:    time.Duration(getIntEnv("FEED_DEAD_AFTER_DAYS", 14)) * 24 * time.Hour,
+	})
+	refresher.Start()
+
+	// Pick up imports that were still running when the server stopped
+	err = services.ResumeImportJobs(db)
+	if err != nil {
+		fmt.Println(err)
+	}
+
 	// Setup template engine
 	engine := html.New("./src/templates", ".html")
-	
+
 	// Add custom template functions
 	engine.AddFunc("minus", func(a, b int) int { return a - b })
 	engine.AddFunc("add", func(a, b int) int { return a + b })
@@ -40,6 +204,23 @@ func main() {
 		}
 		return result
 	})
+	engine.AddFunc("contains", func(values []string, value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+	engine.AddFunc("plainText", services.PlainText)
+	engine.AddFunc("highlight", func(snippet string) template.HTML {
+		return template.HTML(services.HighlightSnippet(snippet))
+	})
+	// Item bodies are sanitized when stored; doing it again on output also
+	// covers items stored before sanitizing was introduced
+	engine.AddFunc("itemHTML", func(fragment string, baseUrl string) template.HTML {
+		return template.HTML(services.SanitizeHTML(fragment, baseUrl))
+	})
 	engine.AddFunc("formatDate", func(dateStr string) string {
 		if dateStr == "" {
 			return ""
@@ -53,7 +234,7 @@ func main() {
 			"2006-01-02 15:04:05",             // Simple datetime
 			"02 Jan 2006 15:04:05 MST",        // Common RSS format
 		}
-		
+
 		var parsedTime time.Time
 		var err error
 		for _, format := range formats {
@@ -62,18 +243,19 @@ func main() {
 				break
 			}
 		}
-		
+
 		if err != nil {
 			// If we can't parse it, return the original string
 			return dateStr
 		}
-		
+
 		// Format in a user-friendly way
 		return parsedTime.Format("Jan 2, 2006 3:04 PM")
 	})
 
 	app := fiber.New(fiber.Config{
-		Views: engine,
+		Views:             engine,
+		PassLocalsToViews: true,
 	})
 
 	// Setup session/store for cookies
@@ -94,9 +276,32 @@ func main() {
 		}
 
 		c.Locals("user_id", userID)
+
 		return c.Next()
 	}
 
+	// renderPage renders a page in the site layout, together with the saved
+	// views listed in its nav when someone is logged in
+	renderPage := func(c *fiber.Ctx, name string, data fiber.Map) error {
+		if userID, ok := c.Locals("user_id").(string); ok {
+			views, err := services.GetUserViewsWithUnread(db, userID)
+			if err != nil {
+				fmt.Println(err)
+			}
+			data["NavViews"] = views
+		}
+
+		return c.Render(name, data, "base")
+	}
+
+	// API tokens are JWTs signed with JWT_SECRET, and disabled without one
+	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
+	var bearerAuth fiber.Handler
+	if len(jwtSecret) > 0 {
+		bearerAuth = tokenAuth(db, jwtSecret)
+	}
+	apiAuthMiddleware := apiAuth(store, bearerAuth)
+
 	// Public routes
 	app.Get("/", func(c *fiber.Ctx) error {
 		// Check if user is authenticated by trying to get session
@@ -116,9 +321,9 @@ func main() {
 	app.Get("/login", func(c *fiber.Ctx) error {
 		sess, err := store.Get(c)
 		if err != nil {
-			return c.Render("login", fiber.Map{
+			return renderPage(c, "login", fiber.Map{
 				"Title": "Login",
-			}, "base")
+			})
 		}
 
 		data := fiber.Map{
@@ -134,31 +339,31 @@ func main() {
 			}
 		}
 
-		return c.Render("login", data, "base")
+		return renderPage(c, "login", data)
 	})
 
 	app.Post("/login", func(c *fiber.Ctx) error {
 		userId := c.FormValue("userId")
 		if userId == "" {
-			return c.Render("login", fiber.Map{
-				"Title":   "Login",
-				"Error":   "User ID is required",
-			}, "base")
+			return renderPage(c, "login", fiber.Map{
+				"Title": "Login",
+				"Error": "User ID is required",
+			})
 		}
 
 		usr, err := services.GetUser(db, userId)
 		if err != nil {
-			return c.Render("login", fiber.Map{
-				"Title":   "Login",
-				"Error":   "User not found",
-			}, "base")
+			return renderPage(c, "login", fiber.Map{
+				"Title": "Login",
+				"Error": "User not found",
+			})
 		}
 
 		// Create session with long expiry (30 days)
 		sess, err := store.Get(c)
 		if err != nil {
 			return c.SendStatus(fiber.StatusInternalServerError)
-	}
+		}
 
 		sess.Set("user_id", usr.Id)
 		sess.SetExpiry(time.Hour * 24 * 30) // 30 days
@@ -171,18 +376,18 @@ func main() {
 	})
 
 	app.Get("/register", func(c *fiber.Ctx) error {
-		return c.Render("register", fiber.Map{
+		return renderPage(c, "register", fiber.Map{
 			"Title": "Register",
-		}, "base")
+		})
 	})
 
 	app.Post("/register", func(c *fiber.Ctx) error {
 		usr, err := services.CreateUser(db)
 		if err != nil {
-			return c.Render("register", fiber.Map{
-				"Title":   "Register",
-				"Error":   "Failed to create user",
-			}, "base")
+			return renderPage(c, "register", fiber.Map{
+				"Title": "Register",
+				"Error": "Failed to create user",
+			})
 		}
 
 		// Store the new user ID in session temporarily so we can show it on login page
@@ -213,13 +418,16 @@ func main() {
 			pageSize = 25
 		}
 
-		tagId := c.Query("tag_id", "*")
+		filter := services.ContentFilter{
+			UnreadOnly: c.Query("unread") == "1",
+			Tags:       tagFilter(queryValues(c)),
+		}
 
-		tags, err := services.GetUserTags(db, userID)
+		tags, err := services.GetUserTagsWithUnread(db, userID)
 		if err != nil {
 			fmt.Println(err)
 
-			return c.Render("index", fiber.Map{
+			return renderPage(c, "index", fiber.Map{
 				"Title":       "Your RSS Feed",
 				"Error":       "Failed to load content",
 				"Content":     []services.FeedContentWithSource{},
@@ -227,14 +435,14 @@ func main() {
 				"TotalPages":  0,
 				"PageSize":    0,
 				"TotalCount":  0,
-			}, "base")
+			})
 		}
 
-		content, err := services.GetContent(db, userID, page, pageSize, tagId)
+		content, err := services.GetContent(db, userID, page, pageSize, filter)
 		if err != nil {
 			fmt.Println(err)
-						
-			return c.Render("index", fiber.Map{
+
+			return renderPage(c, "index", fiber.Map{
 				"Title":       "Your RSS Feed",
 				"Error":       "Failed to load content",
 				"Content":     []services.FeedContentWithSource{},
@@ -242,15 +450,15 @@ func main() {
 				"TotalPages":  0,
 				"PageSize":    0,
 				"TotalCount":  0,
-			}, "base")
+			})
 		}
 
 		// Get total count for pagination
-		totalCount, err := services.GetContentCount(db, userID, tagId)
+		totalCount, err := services.GetContentCount(db, userID, filter)
 		if err != nil {
 			fmt.Println(err)
 
-			return c.Render("index", fiber.Map{
+			return renderPage(c, "index", fiber.Map{
 				"Title":       "Your RSS Feed",
 				"Error":       "Failed to load content",
 				"Content":     []services.FeedContentWithSource{},
@@ -258,7 +466,7 @@ func main() {
 				"TotalPages":  0,
 				"PageSize":    0,
 				"TotalCount":  0,
-			}, "base")
+			})
 		}
 
 		// Calculate total pages
@@ -267,176 +475,1139 @@ func main() {
 			totalPages = (totalCount + pageSize - 1) / pageSize
 		}
 
-		return c.Render("index", fiber.Map{
+		return renderPage(c, "index", fiber.Map{
 			"Title":       "Your RSS Feed",
+			"Path":        "/content",
+			"Query":       pageQuery(c),
 			"Content":     content,
 			"CurrentPage": page,
 			"TotalPages":  totalPages,
 			"PageSize":    pageSize,
 			"TotalCount":  totalCount,
 			"Tags":        tags,
-			"CurrentTagId": tagId,
-		}, "base")
+			"TagFilter":   filter.Tags,
+			"UnreadOnly":  filter.UnreadOnly,
+			"LoadedAt":    time.Now().UTC().Format(time.RFC3339),
+		})
 	})
 
-	app.Get("/feeds", authMiddleware, func(c *fiber.Ctx) error {
+	// Read state routes
+	app.Get("/items/:itemId", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
 
-		// Get all tags for the user
-		tags, err := services.GetUserTags(db, userID)
+		item, err := services.GetItem(db, userID, c.Params("itemId"))
 		if err != nil {
-			fmt.Println(err)
-			tags = []services.Tag{}
+			return c.Redirect("/content")
 		}
 
-		// Get feeds with their tags
-		feeds, err := services.GetUserFeedsWithTags(db, userID)
+		// Opening an item counts as reading it
+		if !item.IsRead {
+			err = services.MarkItemRead(db, userID, item.Id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		// Navigate within the timeline the item was opened from
+		filter := services.ContentFilter{
+			UnreadOnly: c.Query("unread") == "1",
+			Tags:       tagFilter(queryValues(c)),
+		}
+
+		previousId, nextId, err := services.GetAdjacentItems(db, userID, item, filter)
 		if err != nil {
 			fmt.Println(err)
-			return c.Render("feeds", fiber.Map{
-				"Title": "Your Feeds",
-				"Error": "Failed to load feeds",
-				"Feeds": []services.FeedWithTags{},
-				"Tags": tags,
-			}, "base")
 		}
 
-		return c.Render("feeds", fiber.Map{
-			"Title": "Your Feeds",
-			"Feeds": feeds,
-			"Tags": tags,
-			"AllTags": tags, // For the add tag dropdown
-		}, "base")
+		return renderPage(c, "item", fiber.Map{
+			"Title":      item.Title,
+			"Item":       item,
+			"PreviousId": previousId,
+			"NextId":     nextId,
+			"Query":      pageQuery(c),
+		})
 	})
 
-	app.Get("/add-feed", authMiddleware, func(c *fiber.Ctx) error {
-		return c.Render("add_feed", fiber.Map{
-			"Title": "Add RSS Feed",
-		}, "base")
+	app.Post("/items/:itemId/read", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.MarkItemRead(db, userID, c.Params("itemId"))
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return redirectBack(c, "/content")
 	})
 
-	app.Post("/add-feed", authMiddleware, func(c *fiber.Ctx) error {
+	app.Post("/items/:itemId/unread", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
-		url := c.FormValue("url")
 
-		if url == "" {
-			return c.Render("add_feed", fiber.Map{
-				"Title": "Add RSS Feed",
-				"Error": "URL is required",
-			}, "base")
+		err := services.MarkItemUnread(db, userID, c.Params("itemId"))
+		if err != nil {
+			fmt.Println(err)
 		}
 
-		_, err := services.AddUserFeed(db, userID, url)
+		return redirectBack(c, "/content")
+	})
+
+	app.Post("/items/:itemId/star", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.StarItem(db, userID, c.Params("itemId"))
 		if err != nil {
-			return c.Render("add_feed", fiber.Map{
-				"Title": "Add RSS Feed",
-				"Error": "Failed to add feed: " + err.Error(),
-			}, "base")
+			fmt.Println(err)
 		}
 
-		return c.Render("add_feed", fiber.Map{
-			"Title":   "Add RSS Feed",
-			"Success": "Feed added successfully!",
-		}, "base")
+		return redirectBack(c, "/content")
 	})
 
-	app.Post("/feeds/:feedId/delete", authMiddleware, func(c *fiber.Ctx) error {
+	app.Post("/items/:itemId/unstar", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
-		feedId := c.Params("feedId")
 
-		err := services.DeleteUserFeed(db, userID, feedId)
+		err := services.UnstarItem(db, userID, c.Params("itemId"))
 		if err != nil {
 			fmt.Println(err)
 		}
 
-		return c.Redirect("/feeds")
+		return redirectBack(c, "/starred")
 	})
 
-	// Tag management routes
-	app.Post("/tags/create", authMiddleware, func(c *fiber.Ctx) error {
+	app.Get("/starred", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
-		tagName := c.FormValue("tag_name")
 
-		if tagName == "" {
-			return c.Redirect("/feeds")
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(c.Query("page_size", "25"))
+		if err != nil || pageSize < 1 {
+			pageSize = 25
 		}
 
-		_, err := services.CreateTag(db, userID, tagName)
+		filter := tagFilter(queryValues(c))
+
+		tags, err := services.GetUserTags(db, userID)
 		if err != nil {
 			fmt.Println(err)
+			tags = []services.Tag{}
 		}
 
-		return c.Redirect("/feeds")
+		items, err := services.GetStarredItems(db, userID, page, pageSize, filter)
+		if err != nil {
+			fmt.Println(err)
+
+			return renderPage(c, "starred", fiber.Map{
+				"Title":       "Starred",
+				"Error":       "Failed to load starred items",
+				"Path":        "/starred",
+				"Content":     []services.StarredItem{},
+				"Tags":        tags,
+				"TagFilter":   filter,
+				"CurrentPage": 0,
+				"TotalPages":  0,
+				"PageSize":    0,
+				"TotalCount":  0,
+			})
+		}
+
+		totalCount, err := services.GetStarredCount(db, userID, filter)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		totalPages := 1
+		if pageSize > 0 && totalCount > 0 {
+			totalPages = (totalCount + pageSize - 1) / pageSize
+		}
+
+		return renderPage(c, "starred", fiber.Map{
+			"Title":       "Starred",
+			"Path":        "/starred",
+			"Query":       pageQuery(c),
+			"Content":     items,
+			"CurrentPage": page,
+			"TotalPages":  totalPages,
+			"PageSize":    pageSize,
+			"TotalCount":  totalCount,
+			"Tags":        tags,
+			"TagFilter":   filter,
+		})
 	})
 
-	app.Get("/tags/:tagId/delete", authMiddleware, func(c *fiber.Ctx) error {
+	app.Post("/content/mark-read", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
-		tagId := c.Params("tagId")
 
-		err := services.DeleteTag(db, userID, tagId)
+		scope := services.MarkReadScope{
+			FeedId: c.FormValue("feed_id"),
+			Tags:   tagFilter(formValues(c)),
+		}
+
+		if before := c.FormValue("before"); before != "" {
+			var err error
+			scope.Before, err = time.Parse(time.RFC3339Nano, before)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid before time")
+			}
+		}
+
+		if viewId := c.FormValue("view_id"); viewId != "" {
+			view, err := services.GetView(db, userID, viewId)
+			if err != nil {
+				fmt.Println(err)
+				return redirectBack(c, "/views")
+			}
+
+			scope.View, err = services.ParseViewQuery(view.Query)
+			if err != nil {
+				fmt.Println(err)
+				return redirectBack(c, "/views/"+viewId)
+			}
+		}
+
+		err := services.MarkAllRead(db, userID, scope)
 		if err != nil {
 			fmt.Println(err)
 		}
 
-		return c.Redirect("/feeds")
+		return redirectBack(c, "/content")
 	})
 
-	app.Post("/feeds/:feedId/tags/add", authMiddleware, func(c *fiber.Ctx) error {
-		feedId := c.Params("feedId")
-		tagId := c.FormValue("tag_id")
+	renderViews := func(c *fiber.Ctx, userID string, data fiber.Map) error {
+		views, err := services.GetUserViews(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			views = []services.View{}
+		}
 
-		if tagId == "" {
-			return c.Redirect("/feeds")
+		data["Title"] = "Views"
+		data["Views"] = views
+
+		return renderPage(c, "views", data)
+	}
+
+	app.Get("/views", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderViews(c, userID, fiber.Map{})
+	})
+
+	app.Post("/views/create", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		name := strings.TrimSpace(c.FormValue("name"))
+		query := strings.TrimSpace(c.FormValue("query"))
+
+		if name == "" {
+			return renderViews(c, userID, fiber.Map{
+				"Error":    "Please give the view a name",
+				"NewName":  name,
+				"NewQuery": query,
+			})
 		}
 
-		err := services.AddTagToFeed(db, feedId, tagId)
+		view, err := services.CreateView(db, userID, name, query)
 		if err != nil {
 			fmt.Println(err)
+
+			return renderViews(c, userID, fiber.Map{
+				"Error":    "Failed to save view: " + err.Error(),
+				"NewName":  name,
+				"NewQuery": query,
+			})
 		}
 
-		return c.Redirect("/feeds")
+		return c.Redirect("/views/" + view.Id)
 	})
 
-	app.Post("/feeds/:feedId/tags/:tagId/remove", authMiddleware, func(c *fiber.Ctx) error {
-		feedId := c.Params("feedId")
-		tagId := c.Params("tagId")
+	app.Get("/views/:viewId", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		viewId := c.Params("viewId")
+
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(c.Query("page_size", "25"))
+		if err != nil || pageSize < 1 {
+			pageSize = 25
+		}
 
-		err := services.RemoveTagFromFeed(db, feedId, tagId)
+		view, err := services.GetView(db, userID, viewId)
 		if err != nil {
 			fmt.Println(err)
+			return c.Redirect("/views")
 		}
 
-		return c.Redirect("/feeds")
+		data := fiber.Map{
+			"Title":       view.Name,
+			"Path":        "/views/" + view.Id,
+			"Query":       pageQuery(c),
+			"View":        view,
+			"Content":     []services.FeedContentWithSource{},
+			"CurrentPage": 0,
+			"TotalPages":  0,
+			"PageSize":    0,
+			"TotalCount":  0,
+			"LoadedAt":    time.Now().UTC().Format(time.RFC3339),
+		}
+
+		query, err := services.ParseViewQuery(view.Query)
+		if err != nil {
+			data["Error"] = "This view's query is invalid: " + err.Error()
+			return renderPage(c, "view", data)
+		}
+
+		filter := services.ContentFilter{View: query}
+
+		content, err := services.GetContent(db, userID, page, pageSize, filter)
+		if err != nil {
+			fmt.Println(err)
+			data["Error"] = "Failed to load content"
+			return renderPage(c, "view", data)
+		}
+
+		totalCount, err := services.GetContentCount(db, userID, filter)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		totalPages := 1
+		if pageSize > 0 && totalCount > 0 {
+			totalPages = (totalCount + pageSize - 1) / pageSize
+		}
+
+		data["Content"] = content
+		data["CurrentPage"] = page
+		data["TotalPages"] = totalPages
+		data["PageSize"] = pageSize
+		data["TotalCount"] = totalCount
+
+		return renderPage(c, "view", data)
 	})
 
-	app.Get("/update", authMiddleware, func(c *fiber.Ctx) error {
+	app.Post("/views/:viewId", authMiddleware, func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(string)
+		viewId := c.Params("viewId")
+		name := strings.TrimSpace(c.FormValue("name"))
+		query := strings.TrimSpace(c.FormValue("query"))
+
+		if name == "" {
+			return renderViews(c, userID, fiber.Map{
+				"Error": "Please give the view a name",
+			})
+		}
 
-		err := services.UpdateUserContent(db, userID)
+		err := services.UpdateView(db, userID, viewId, name, query)
 		if err != nil {
 			fmt.Println(err)
-			return c.Render("index", fiber.Map{
-				"Title":   "Update Content",
-				"Error":   "Failed to update content",
-				"Content": []services.FeedContentWithSource{},
-			}, "base")
+
+			return renderViews(c, userID, fiber.Map{
+				"Error": "Failed to save view: " + err.Error(),
+			})
 		}
 
-		return c.Redirect("/content")
+		return c.Redirect("/views/" + viewId)
 	})
 
-	app.Get("/logout", func(c *fiber.Ctx) error {
-		sess, err := store.Get(c)
+	app.Post("/views/:viewId/delete", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.DeleteView(db, userID, c.Params("viewId"))
 		if err != nil {
-			return c.Redirect("/login")
+			fmt.Println(err)
 		}
 
-		if err := sess.Destroy(); err != nil {
-			return c.SendStatus(fiber.StatusInternalServerError)
+		return c.Redirect("/views")
+	})
+
+	app.Get("/search", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
 		}
 
-		return c.Redirect("/login")
-	})
+		pageSize, err := strconv.Atoi(c.Query("page_size", "25"))
+		if err != nil || pageSize < 1 {
+			pageSize = 25
+		}
+
+		query := services.SearchQuery{
+			Query:  strings.TrimSpace(c.Query("q")),
+			TagId:  c.Query("tag_id", "*"),
+			FeedId: c.Query("feed_id"),
+			From:   c.Query("from"),
+			To:     c.Query("to"),
+		}
+
+		tags, err := services.GetUserTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			tags = []services.Tag{}
+		}
+
+		feeds, err := services.GetUserFeeds(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			feeds = []services.Feed{}
+		}
+
+		data := fiber.Map{
+			"Title":       "Search",
+			"Path":        "/search",
+			"Query":       pageQuery(c),
+			"Search":      query,
+			"Tags":        tags,
+			"Feeds":       feeds,
+			"Results":     []services.SearchResult{},
+			"CurrentPage": page,
+			"TotalPages":  0,
+			"PageSize":    pageSize,
+			"TotalCount":  0,
+		}
+
+		for _, date := range []string{query.From, query.To} {
+			if _, err := time.Parse(time.DateOnly, date); date != "" && err != nil {
+				data["Error"] = "Dates must look like 2024-01-31"
+				c.Status(fiber.StatusBadRequest)
+				return renderPage(c, "search", data)
+			}
+		}
+
+		if query.Query == "" {
+			return renderPage(c, "search", data)
+		}
+
+		results, err := services.SearchContent(db, userID, query, page, pageSize)
+		if err != nil {
+			fmt.Println(err)
+			data["Error"] = "Search failed"
+			return renderPage(c, "search", data)
+		}
+
+		totalCount, err := services.SearchContentCount(db, userID, query)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		totalPages := 1
+		if pageSize > 0 && totalCount > 0 {
+			totalPages = (totalCount + pageSize - 1) / pageSize
+		}
+
+		data["Results"] = results
+		data["TotalPages"] = totalPages
+		data["TotalCount"] = totalCount
+
+		return renderPage(c, "search", data)
+	})
+
+	renderFeeds := func(c *fiber.Ctx, userID string, data fiber.Map) error {
+		data["Title"] = "Your Feeds"
+
+		// Get all tags for the user
+		tags, err := services.GetUserTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			tags = []services.Tag{}
+		}
+		data["Tags"] = tags
+
+		// Get feeds with their tags
+		feeds, err := services.GetUserFeedsWithTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			data["Error"] = "Failed to load feeds"
+			data["Feeds"] = []services.FeedWithTags{}
+			return renderPage(c, "feeds", data)
+		}
+
+		data["Feeds"] = feeds
+		data["TagTree"] = services.BuildTagTree(tags, feeds)
+		data["AllTags"] = tags // For the add tag dropdown
+		data["LoadedAt"] = time.Now().UTC().Format(time.RFC3339)
+
+		return renderPage(c, "feeds", data)
+	}
+
+	app.Get("/feeds", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderFeeds(c, userID, fiber.Map{})
+	})
+
+	app.Get("/feeds/:feedId", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		feedId := c.Params("feedId")
+
+		feed, err := services.GetUserFeed(db, userID, feedId)
+		if err != nil {
+			return c.Redirect("/feeds")
+		}
+
+		subscription, err := services.GetSubscription(db, userID, feedId)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		title := feed.Title
+		if subscription.CustomTitle != "" {
+			title = subscription.CustomTitle
+		}
+
+		fetches, err := services.GetFeedFetches(db, feedId, 20)
+		if err != nil {
+			fmt.Println(err)
+			return renderPage(c, "feed", fiber.Map{
+				"Title":        title,
+				"Error":        "Failed to load fetch history",
+				"Feed":         feed,
+				"Subscription": subscription,
+				"Fetches":      []services.FeedFetch{},
+			})
+		}
+
+		return renderPage(c, "feed", fiber.Map{
+			"Title":        title,
+			"Feed":         feed,
+			"Subscription": subscription,
+			"Fetches":      fetches,
+		})
+	})
+
+	app.Post("/feeds/:feedId/settings", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		feedId := c.Params("feedId")
+
+		err := services.UpdateSubscription(db, userID, feedId, services.SubscriptionSettings{
+			CustomTitle: strings.TrimSpace(c.FormValue("custom_title")),
+			Paused:      c.FormValue("paused") == "1",
+			Note:        strings.TrimSpace(c.FormValue("note")),
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/feeds/" + feedId)
+	})
+
+	app.Post("/feeds/:feedId/pause", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.SetSubscriptionPaused(db, userID, c.Params("feedId"), true)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return redirectBack(c, "/feeds")
+	})
+
+	app.Post("/feeds/:feedId/resume", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.SetSubscriptionPaused(db, userID, c.Params("feedId"), false)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return redirectBack(c, "/feeds")
+	})
+
+	app.Get("/add-feed", authMiddleware, func(c *fiber.Ctx) error {
+		return renderPage(c, "add_feed", fiber.Map{
+			"Title": "Add RSS Feed",
+		})
+	})
+
+	app.Post("/add-feed", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		url := c.FormValue("url")
+
+		if url == "" {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title": "Add RSS Feed",
+				"Error": "URL is required",
+			})
+		}
+
+		_, err := services.AddUserFeed(db, userID, url)
+
+		var choice *services.FeedChoiceError
+		if errors.As(err, &choice) {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title":   "Add RSS Feed",
+				"Choices": choice.Feeds,
+			})
+		}
+		if errors.Is(err, services.ErrAlreadySubscribed) {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title": "Add RSS Feed",
+				"Error": "You're already subscribed to this feed.",
+			})
+		}
+		if err != nil {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title": "Add RSS Feed",
+				"Error": "Failed to add feed: " + err.Error(),
+			})
+		}
+
+		return renderPage(c, "add_feed", fiber.Map{
+			"Title":   "Add RSS Feed",
+			"Success": "Feed added successfully!",
+		})
+	})
+
+	app.Post("/add-feed/preview", authMiddleware, func(c *fiber.Ctx) error {
+		url := c.FormValue("url")
+
+		if url == "" {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title": "Add RSS Feed",
+				"Error": "URL is required",
+			})
+		}
+
+		preview, err := services.PreviewFeed(c.Context(), url)
+
+		var choice *services.FeedChoiceError
+		if errors.As(err, &choice) {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title":   "Add RSS Feed",
+				"Choices": choice.Feeds,
+			})
+		}
+		if err != nil {
+			return renderPage(c, "add_feed", fiber.Map{
+				"Title": "Add RSS Feed",
+				"Error": "Failed to preview feed: " + err.Error(),
+			})
+		}
+
+		return renderPage(c, "preview_feed", fiber.Map{
+			"Title":   "Preview " + preview.Title,
+			"Preview": preview,
+		})
+	})
+
+	// Output feeds, authenticated by the feed token in their URL or like the
+	// API
+	outputFormats := map[string]struct {
+		contentType string
+		write       func(io.Writer, services.OutputFeed) error
+	}{
+		"atom.xml":  {"application/atom+xml; charset=utf-8", services.WriteAtom},
+		"rss.xml":   {"application/rss+xml; charset=utf-8", services.WriteRSS},
+		"feed.json": {"application/feed+json; charset=utf-8", services.WriteJSONFeed},
+	}
+
+	serveOutputFeed := func(c *fiber.Ctx, userID string) error {
+		format, ok := outputFormats[c.Params("format")]
+		if !ok {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		filter := services.ContentFilter{
+			UnreadOnly: c.Query("unread") == "1",
+			Tags:       tagFilter(queryValues(c)),
+		}
+
+		items, err := services.GetContent(db, userID, 1, outputFeedSize, filter)
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// Name the feed after the tags it is limited to
+		title := "RSS f33d"
+		if len(filter.Tags.Include) > 0 {
+			tags, err := services.GetUserTags(db, userID)
+			if err != nil {
+				fmt.Println(err)
+			}
+
+			names := []string{}
+			for _, tag := range tags {
+				if slices.Contains(filter.Tags.Include, tag.Id) {
+					names = append(names, tag.Path)
+				}
+			}
+			title += ": " + strings.Join(names, ", ")
+		}
+
+		homeUrl := c.BaseURL() + "/content"
+		if query := pageQuery(c); query != "" {
+			homeUrl += "?" + string(query)
+		}
+
+		feed := services.OutputFeed{
+			Title:   title,
+			SelfUrl: c.BaseURL() + c.OriginalURL(),
+			HomeUrl: homeUrl,
+			Items:   items,
+		}
+
+		var body bytes.Buffer
+		err = format.write(&body, feed)
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body.Bytes()))
+		c.Set(fiber.HeaderETag, etag)
+		if updated := feed.Updated(); !updated.IsZero() {
+			c.Set(fiber.HeaderLastModified, updated.UTC().Format(http.TimeFormat))
+		}
+
+		if notModified(c, etag, feed.Updated()) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		c.Set(fiber.HeaderContentType, format.contentType)
+		return c.Send(body.Bytes())
+	}
+
+	app.Get("/output/:token/:format", func(c *fiber.Ctx) error {
+		user, err := services.GetUserByFeedToken(db, c.Params("token"))
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return serveOutputFeed(c, user.Id)
+	})
+
+	app.Get("/output/:format", apiAuthMiddleware, func(c *fiber.Ctx) error {
+		return serveOutputFeed(c, c.Locals("user_id").(string))
+	})
+
+	renderSettings := func(c *fiber.Ctx, userID string, data fiber.Map) error {
+		user, err := services.GetUser(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		tags, err := services.GetUserTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		tokens, err := services.GetUserApiTokens(db, userID)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		data["Title"] = "Settings"
+		data["OutputUrl"] = c.BaseURL() + "/output/" + user.FeedToken
+		data["Tags"] = tags
+		data["ApiTokens"] = tokens
+		data["ApiTokensEnabled"] = len(jwtSecret) > 0
+
+		return renderPage(c, "settings", data)
+	}
+
+	app.Get("/settings", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderSettings(c, userID, fiber.Map{})
+	})
+
+	app.Post("/settings/tokens", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		token, signed, err := services.CreateApiToken(db, jwtSecret, userID, c.FormValue("name"), c.FormValue("read_only") == "1")
+		if err != nil {
+			fmt.Println(err)
+			return renderSettings(c, userID, fiber.Map{"Error": "Failed to create token: " + err.Error()})
+		}
+
+		// The token is only ever shown here
+		return renderSettings(c, userID, fiber.Map{
+			"NewToken":    token,
+			"NewTokenJWT": signed,
+		})
+	})
+
+	app.Post("/settings/tokens/:tokenId/revoke", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.RevokeApiToken(db, userID, c.Params("tokenId"))
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/settings")
+	})
+
+	app.Post("/settings/feed-token", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.ResetFeedToken(db, userID)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/settings")
+	})
+
+	// OPML import routes
+	renderImport := func(c *fiber.Ctx, userID string, data fiber.Map) error {
+		jobs, err := services.GetUserImportJobs(db, userID, 10)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		data["Title"] = "Import OPML"
+		data["Jobs"] = jobs
+
+		return renderPage(c, "import", data)
+	}
+
+	app.Get("/import", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderImport(c, userID, fiber.Map{})
+	})
+
+	app.Post("/import", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feeds, err := readOPML(c)
+		if err != nil {
+			return renderImport(c, userID, fiber.Map{"Error": "Failed to read OPML: " + err.Error()})
+		}
+
+		job, err := services.CreateImportJob(db, userID, feeds)
+		if err != nil {
+			return renderImport(c, userID, fiber.Map{"Error": "Failed to import: " + err.Error()})
+		}
+
+		go func() {
+			err := services.RunImportJob(db, job.Id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}()
+
+		return c.Redirect("/import/" + job.Id)
+	})
+
+	app.Get("/import/:jobId", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		job, err := services.GetImportJob(db, userID, c.Params("jobId"))
+		if err != nil {
+			return c.Redirect("/import")
+		}
+
+		items, err := services.GetImportItems(db, job.Id)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		data := fiber.Map{
+			"Title": "Import",
+			"Job":   job,
+			"Items": items,
+		}
+		// Reload the page until the import is done
+		if !job.Done() {
+			data["Refresh"] = 3
+		}
+
+		return renderPage(c, "import_job", data)
+	})
+
+	app.Get("/export/opml", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feeds, err := services.GetUserFeedsWithTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		tags, err := services.GetUserTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		c.Attachment("subscriptions-" + time.Now().Format("2006-01-02") + ".opml")
+		c.Set(fiber.HeaderContentType, "text/x-opml; charset=utf-8")
+
+		return services.WriteOPML(c, "RSS f33d subscriptions", tags, feeds)
+	})
+
+	app.Post("/feeds/:feedId/delete", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		feedId := c.Params("feedId")
+
+		err := services.DeleteUserFeed(db, userID, feedId)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Post("/feeds/:feedId/revive", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		feedId := c.Params("feedId")
+
+		// Only subscribers may revive a feed
+		_, err := services.GetUserFeed(db, userID, feedId)
+		if err != nil {
+			return c.Redirect("/feeds")
+		}
+
+		err = services.ReviveFeed(db, feedId)
+		if err != nil {
+			fmt.Println(err)
+		}
+		refresher.Trigger()
+
+		return c.Redirect("/feeds")
+	})
+
+	// Tag management routes
+	app.Post("/tags/create", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		tagName := c.FormValue("tag_name")
+
+		if tagName == "" {
+			return c.Redirect("/feeds")
+		}
+
+		_, err := services.CreateTag(db, userID, tagName, c.FormValue("parent_id"))
+		if err != nil {
+			fmt.Println(err)
+			return renderFeeds(c, userID, fiber.Map{
+				"Error": "Failed to create tag: " + err.Error(),
+			})
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	// renderTag shows a page about one of the user's tags
+	renderTag := func(c *fiber.Ctx, userID string, tagId string, view string, data fiber.Map) error {
+		tags, err := services.GetUserTags(db, userID)
+		if err != nil {
+			fmt.Println(err)
+			return c.Redirect("/feeds")
+		}
+
+		for _, tag := range tags {
+			if tag.Id == tagId {
+				children, err := services.GetTagChildren(db, userID, tagId)
+				if err != nil {
+					fmt.Println(err)
+				}
+
+				parentId := ""
+				if tag.ParentId != nil {
+					parentId = *tag.ParentId
+				}
+
+				data["Title"] = tag.Path
+				data["Tag"] = tag
+				data["ParentId"] = parentId
+				data["Tags"] = tags
+				data["Children"] = children
+
+				return renderPage(c, view, data)
+			}
+		}
+
+		return c.Redirect("/feeds")
+	}
+
+	app.Get("/tags/:tagId", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderTag(c, userID, c.Params("tagId"), "tag", fiber.Map{})
+	})
+
+	app.Post("/tags/:tagId", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		tagId := c.Params("tagId")
+
+		color := ""
+		if c.FormValue("use_color") == "1" {
+			color = c.FormValue("color")
+		}
+
+		err := services.UpdateTag(db, userID, tagId, c.FormValue("name"), color)
+		if err == nil {
+			err = services.SetTagParent(db, userID, tagId, c.FormValue("parent_id"))
+		}
+		if err != nil {
+			fmt.Println(err)
+			return renderTag(c, userID, tagId, "tag", fiber.Map{
+				"Error": "Failed to save tag: " + err.Error(),
+			})
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Post("/tags/:tagId/order", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		offset := 1
+		if c.FormValue("direction") == "up" {
+			offset = -1
+		}
+
+		err := services.MoveTagAmongSiblings(db, userID, c.Params("tagId"), offset)
+		if err != nil {
+			fmt.Println(err)
+			return renderFeeds(c, userID, fiber.Map{
+				"Error": "Failed to move tag: " + err.Error(),
+			})
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Post("/tags/:tagId/merge", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		tagId := c.Params("tagId")
+
+		err := services.MergeTag(db, userID, tagId, c.FormValue("into_tag_id"))
+		if err != nil {
+			fmt.Println(err)
+			return renderTag(c, userID, tagId, "tag", fiber.Map{
+				"Error": "Failed to merge tag: " + err.Error(),
+			})
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	// Ask what to do with nested tags before deleting them
+	app.Get("/tags/:tagId/delete", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		return renderTag(c, userID, c.Params("tagId"), "delete_tag", fiber.Map{})
+	})
+
+	app.Post("/tags/:tagId/delete", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		err := services.DeleteTag(db, userID, c.Params("tagId"), c.FormValue("children") == "delete")
+		if err != nil {
+			fmt.Println(err)
+			return renderFeeds(c, userID, fiber.Map{
+				"Error": "Failed to delete tag: " + err.Error(),
+			})
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Post("/feeds/:feedId/tags/add", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+		tagId := c.FormValue("tag_id")
+
+		if tagId == "" {
+			return c.Redirect("/feeds")
+		}
+
+		// Both the feed and the tag have to be the user's own
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			fmt.Println(err)
+			return c.Redirect("/feeds")
+		}
+
+		tag, err := services.GetTag(db, userID, tagId)
+		if err != nil {
+			fmt.Println(err)
+			return c.Redirect("/feeds")
+		}
+
+		err = services.AddTagToFeed(db, feed.Id, tag.Id)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Post("/feeds/:feedId/tags/:tagId/remove", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		feed, err := services.GetUserFeed(db, userID, c.Params("feedId"))
+		if err != nil {
+			fmt.Println(err)
+			return c.Redirect("/feeds")
+		}
+
+		tag, err := services.GetTag(db, userID, c.Params("tagId"))
+		if err != nil {
+			fmt.Println(err)
+			return c.Redirect("/feeds")
+		}
+
+		err = services.RemoveTagFromFeed(db, feed.Id, tag.Id)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		return c.Redirect("/feeds")
+	})
+
+	app.Get("/update", authMiddleware, func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(string)
+
+		// Feeds are refreshed in the background, this only asks for it to happen sooner
+		err := services.ExpediteUserFeeds(db, userID)
+		if err != nil {
+			fmt.Println(err)
+		}
+		refresher.Trigger()
+
+		return c.Redirect("/content")
+	})
+
+	registerAPI(app, db, refresher, apiAuthMiddleware)
+
+	app.Get("/logout", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return c.Redirect("/login")
+		}
+
+		if err := sess.Destroy(); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.Redirect("/login")
+	})
+
+	// Stop accepting requests on shutdown, then cancel any refresh in progress
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		if err := app.Shutdown(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	if err := app.Listen(":" + port); err != nil {
+		log.Fatalln(err)
+	}
 
-	log.Fatalln(app.Listen(":" + port))
+	refresher.Stop()
 }
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// DiscoveredFeed is a feed found on a regular web page.
+type DiscoveredFeed struct {
+	Url   string `json:"url"`
+	Title string `json:"title"`
+}
+
+// FeedChoiceError is returned when a page links to more than one feed and
+// the user has to pick which one to subscribe to.
+type FeedChoiceError struct {
+	Feeds []DiscoveredFeed
+}
+
+func (e *FeedChoiceError) Error() string {
+	return fmt.Sprintf("found %d feeds on this page, pick one", len(e.Feeds))
+}
+
+// Paths where sites commonly serve their feed
+var wellKnownFeedPaths = []string{
+	"/feed",
+	"/rss",
+	"/rss.xml",
+	"/atom.xml",
+	"/feed.xml",
+	"/index.xml",
+	"/feed.json",
+}
+
+// Link types that only feeds use. Generic XML and JSON types are left out, as
+// pages also link to oEmbed and REST API documents with those.
+var feedMimeTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// DiscoverFeeds finds the feeds a web page advertises with
+// <link rel="alternate"> tags, falling back to well-known feed paths on the
+// same host. It gives up after the same timeout as AddUserFeed.
+func DiscoverFeeds(ctx context.Context, pageUrl string) ([]DiscoveredFeed, error) {
+	feeds := []DiscoveredFeed{}
+
+	ctx, cancel := context.WithTimeout(ctx, addFeedTimeout)
+	defer cancel()
+	seen := map[string]bool{}
+
+	add := func(feedUrl string, title string) {
+		normalized, err := NormalizeFeedUrl(feedUrl)
+		if err != nil || seen[normalized] {
+			return
+		}
+
+		seen[normalized] = true
+		feeds = append(feeds, DiscoveredFeed{Url: normalized, Title: title})
+	}
+
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return feeds, err
+	}
+
+	links, finalUrl, err := alternateLinks(ctx, pageUrl)
+	if err == nil {
+		base = finalUrl
+		for _, link := range links {
+			add(link.Url, link.Title)
+		}
+	}
+
+	if len(feeds) > 0 {
+		return feeds, nil
+	}
+
+	for _, path := range wellKnownFeedPaths {
+		candidate := base.ResolveReference(&url.URL{Path: path}).String()
+
+		fetched, err := fetchFeed(ctx, candidate, "", "")
+		if err != nil || fetched.NotModified || fetched.Feed == nil {
+			continue
+		}
+
+		add(candidate, fetched.Feed.Title)
+	}
+
+	return feeds, nil
+}
+
+// alternateLinks returns the feeds a page links to, resolved against the
+// URL the page was finally served from.
+func alternateLinks(ctx context.Context, pageUrl string) ([]DiscoveredFeed, *url.URL, error) {
+	links := []DiscoveredFeed{}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pageUrl, nil)
+	if err != nil {
+		return links, nil, err
+	}
+	req.Header.Set("User-Agent", "rss-simple/1.0")
+
+	resp, err := newFetchClient(nil).Do(req)
+	if err != nil {
+		return links, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return links, nil, fmt.Errorf("fetching %s: %s", pageUrl, resp.Status)
+	}
+
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return links, nil, err
+	}
+
+	base := resp.Request.URL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if baseHref, err := base.Parse(href); err == nil {
+			base = baseHref
+		}
+	}
+
+	doc.Find("link[rel][href]").Each(func(_ int, link *goquery.Selection) {
+		rel := strings.Fields(strings.ToLower(link.AttrOr("rel", "")))
+		mimeType := strings.ToLower(strings.TrimSpace(link.AttrOr("type", "")))
+
+		isAlternate := false
+		for _, value := range rel {
+			if value == "alternate" {
+				isAlternate = true
+			}
+		}
+
+		if !isAlternate || !feedMimeTypes[mimeType] {
+			return
+		}
+
+		href, err := base.Parse(link.AttrOr("href", ""))
+		if err != nil {
+			return
+		}
+
+		links = append(links, DiscoveredFeed{
+			Url:   href.String(),
+			Title: strings.TrimSpace(link.AttrOr("title", "")),
+		})
+	})
+
+	return links, resp.Request.URL, nil
+}
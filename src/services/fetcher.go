@@ -0,0 +1,220 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+// fetchedFeed is a parsed feed together with the polling hint its publisher
+// gave us, either in the document itself or in the HTTP response headers.
+// Feed is nil when the server answered 304 Not Modified.
+type fetchedFeed struct {
+	Feed         *gofeed.Feed
+	StatusCode   int
+	Hint         time.Duration
+	NotModified  bool
+	Etag         string
+	LastModified string
+	// Where the feed permanently moved to, if it answered with 301 or 308
+	MovedTo string
+}
+
+// maxFeedSize is the largest feed document we download. Anything bigger is
+// treated as a failed fetch rather than read into memory.
+const maxFeedSize = 10 << 20
+
+// fetchFeed downloads and parses a feed. When the validators from a previous
+// fetch are given, the request is made conditional and an unchanged feed is
+// neither downloaded nor parsed.
+func fetchFeed(ctx context.Context, feedUrl string, etag string, lastModified string) (fetchedFeed, error) {
+	result := fetchedFeed{}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", feedUrl, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("User-Agent", "rss-simple/1.0")
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	// Only a chain made up entirely of permanent redirects moves the feed
+	permanent := true
+	client := newFetchClient(func(req *http.Request) {
+		code := req.Response.StatusCode
+		if permanent && (code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect) {
+			result.MovedTo = req.URL.String()
+		} else {
+			permanent = false
+			result.MovedTo = ""
+		}
+	})
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+
+	if resp.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		result.Etag = etag
+		result.LastModified = lastModified
+		result.Hint = httpCacheHint(resp.Header)
+		return result, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+	if err != nil {
+		return result, err
+	}
+	if len(body) > maxFeedSize {
+		return result, errors.New("feed is larger than 10 MB")
+	}
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+
+	result.Feed = feed
+	result.Etag = resp.Header.Get("ETag")
+	result.LastModified = resp.Header.Get("Last-Modified")
+	result.Hint = maxDuration(
+		httpCacheHint(resp.Header),
+		rssTtlHint(feed, body),
+		syndicationHint(feed),
+	)
+
+	return result, nil
+}
+
+// newFetchClient returns the client feeds and web pages are downloaded with.
+// It gives up after 10 redirects and tells onRedirect about every redirect it
+// follows. Requests are bounded by their context.
+func newFetchClient(onRedirect func(req *http.Request)) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			if onRedirect != nil {
+				onRedirect(req)
+			}
+
+			return nil
+		},
+	}
+}
+
+// httpCacheHint reads Cache-Control max-age, falling back to Expires.
+func httpCacheHint(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+
+	return expires.Sub(date)
+}
+
+// rssTtlHint reads the RSS <ttl> element, which the universal feed type does
+// not carry over, so the document is parsed again as plain RSS.
+func rssTtlHint(feed *gofeed.Feed, body []byte) time.Duration {
+	if feed.FeedType != "rss" {
+		return 0
+	}
+
+	rssFeed, err := (&rss.Parser{}).Parse(bytes.NewReader(body))
+	if err != nil || rssFeed.TTL == "" {
+		return 0
+	}
+
+	minutes, err := strconv.Atoi(strings.TrimSpace(rssFeed.TTL))
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// syndicationHint reads sy:updatePeriod and sy:updateFrequency.
+func syndicationHint(feed *gofeed.Feed) time.Duration {
+	sy, ok := feed.Extensions["sy"]
+	if !ok || len(sy["updatePeriod"]) == 0 {
+		return 0
+	}
+
+	periods := map[string]time.Duration{
+		"hourly":  time.Hour,
+		"daily":   24 * time.Hour,
+		"weekly":  7 * 24 * time.Hour,
+		"monthly": 30 * 24 * time.Hour,
+		"yearly":  365 * 24 * time.Hour,
+	}
+
+	period, ok := periods[strings.ToLower(strings.TrimSpace(sy["updatePeriod"][0].Value))]
+	if !ok {
+		return 0
+	}
+
+	frequency := 1
+	if len(sy["updateFrequency"]) > 0 {
+		value, err := strconv.Atoi(strings.TrimSpace(sy["updateFrequency"][0].Value))
+		if err == nil && value > 0 {
+			frequency = value
+		}
+	}
+
+	return period / time.Duration(frequency)
+}
+
+func maxDuration(durations ...time.Duration) time.Duration {
+	result := time.Duration(0)
+	for _, d := range durations {
+		if d > result {
+			result = d
+		}
+	}
+
+	return result
+}
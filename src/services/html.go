@@ -0,0 +1,26 @@
+package services
+
+import (
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// PlainText strips the markup from an HTML fragment and shortens the text to
+// at most limit characters. A limit of zero keeps all of it.
+func PlainText(fragment string, limit int) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(fragment))
+	if err != nil {
+		return ""
+	}
+
+	doc.Find("script, style").Remove()
+	text := strings.Join(strings.Fields(doc.Text()), " ")
+
+	runes := []rune(text)
+	if limit > 0 && len(runes) > limit {
+		return strings.TrimSpace(string(runes[:limit])) + "…"
+	}
+
+	return text
+}
@@ -0,0 +1,425 @@
+package services
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Import service types and functions
+
+// importConcurrency is how many feeds of an import are fetched at once.
+const importConcurrency = 4
+
+// ImportJob is an OPML import running in the background. Status is pending,
+// running, done or failed, with Error saying why the import stopped.
+type ImportJob struct {
+	Id         string  `json:"id"`
+	UserId     string  `db:"user_id" json:"userId"`
+	Status     string  `json:"status"`
+	Total      int     `json:"total"`
+	Processed  int     `json:"processed"`
+	Added      int     `json:"added"`
+	Existing   int     `json:"existing"`
+	Failed     int     `json:"failed"`
+	CreatedAt  string  `db:"created_at" json:"createdAt"`
+	FinishedAt *string `db:"finished_at" json:"finishedAt"`
+	Error      string  `json:"error"`
+}
+
+// Percent is how much of the import is done, from 0 to 100.
+func (j ImportJob) Percent() int {
+	if j.Total == 0 {
+		return 100
+	}
+
+	return j.Processed * 100 / j.Total
+}
+
+// Done tells whether the import has finished, successfully or not.
+func (j ImportJob) Done() bool {
+	return j.Status == "done" || j.Status == "failed"
+}
+
+// ImportItem is one feed outline of an import. Status is pending, added,
+// exists (the user was already subscribed) or failed, with Error saying why.
+type ImportItem struct {
+	Id     string         `json:"id"`
+	JobId  string         `db:"job_id" json:"jobId"`
+	Line   int            `json:"line"`
+	Url    string         `json:"url"`
+	Title  string         `json:"title"`
+	Tags   ImportTagPaths `json:"tags"`
+	Status string         `json:"status"`
+	Error  string         `json:"error"`
+}
+
+// ImportTagPaths stores the tag paths of an import item as JSON, e.g.
+// [["tech", "go"], ["favorites"]].
+type ImportTagPaths [][]string
+
+// Scan implements the sql.Scanner interface for ImportTagPaths
+func (p *ImportTagPaths) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*p = ImportTagPaths{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported type for ImportTagPaths: %T", src)
+	}
+
+	var paths [][]string
+	err := json.Unmarshal(data, &paths)
+	if err != nil {
+		return err
+	}
+	*p = paths
+
+	return nil
+}
+
+// Value implements the driver.Valuer interface for ImportTagPaths
+func (p ImportTagPaths) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(p)
+}
+
+// Joined returns the paths as they are shown for tags, e.g. "tech/go".
+func (p ImportTagPaths) Joined() []string {
+	joined := []string{}
+	for _, path := range p {
+		joined = append(joined, strings.Join(path, "/"))
+	}
+
+	return joined
+}
+
+// CreateImportJob stores the feeds of an OPML document as a pending import
+// for RunImportJob to work through.
+func CreateImportJob(db *sqlx.DB, userId string, feeds []OPMLFeed) (ImportJob, error) {
+	job := ImportJob{}
+	if len(feeds) == 0 {
+		return job, errors.New("the file doesn't contain any feeds")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return job, err
+	}
+	defer tx.Rollback()
+
+	err = tx.Get(
+		&job,
+		`INSERT INTO import_jobs (user_id, total) VALUES ($1, $2) RETURNING *`,
+		userId,
+		len(feeds),
+	)
+	if err != nil {
+		return job, err
+	}
+
+	for _, feed := range feeds {
+		_, err = tx.Exec(
+			`INSERT INTO import_items (job_id, line, url, title, tags) VALUES ($1, $2, $3, $4, $5)`,
+			job.Id,
+			feed.Line,
+			feed.Url,
+			feed.Title,
+			ImportTagPaths(feed.Tags),
+		)
+		if err != nil {
+			return job, err
+		}
+	}
+
+	return job, tx.Commit()
+}
+
+// RunImportJob subscribes the user to the pending feeds of an import. A feed
+// that can't be added is recorded as failed and the import moves on.
+func RunImportJob(db *sqlx.DB, jobId string) error {
+	job := ImportJob{}
+	err := db.Get(
+		&job,
+		`UPDATE import_jobs SET status = 'running' WHERE id = $1 AND status NOT IN ('done', 'failed') RETURNING *`,
+		jobId,
+	)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = importJobItems(db, job)
+	if err != nil {
+		_, updateErr := db.Exec(
+			`UPDATE import_jobs SET status = 'failed', error = $2, finished_at = NOW() WHERE id = $1`,
+			jobId,
+			err.Error(),
+		)
+		if updateErr != nil {
+			fmt.Println(updateErr)
+		}
+
+		return err
+	}
+
+	_, err = db.Exec(
+		`UPDATE import_jobs SET status = 'done', finished_at = NOW() WHERE id = $1`,
+		jobId,
+	)
+
+	return err
+}
+
+// importJobItems imports the pending items of a running job.
+func importJobItems(db *sqlx.DB, job ImportJob) error {
+	items := []ImportItem{}
+	err := db.Select(
+		&items,
+		`SELECT * FROM import_items WHERE job_id = $1 AND status = 'pending' ORDER BY line ASC`,
+		job.Id,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Create every tag up front, so workers don't race to create the same one
+	tagIds := map[string]string{}
+	for _, item := range items {
+		for _, path := range item.Tags {
+			key := strings.Join(path, "\x00")
+			if _, ok := tagIds[key]; ok {
+				continue
+			}
+
+			tagId, err := ensureTagPath(db, job.UserId, path)
+			if err != nil {
+				return err
+			}
+			tagIds[key] = tagId
+		}
+	}
+
+	queue := make(chan ImportItem)
+	var wg sync.WaitGroup
+
+	for i := 0; i < importConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				err := importItem(db, job.UserId, item, tagIds)
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+	}
+
+	for _, item := range items {
+		queue <- item
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return nil
+}
+
+// ResumeImportJobs continues the imports that were interrupted by a restart.
+func ResumeImportJobs(db *sqlx.DB) error {
+	jobIds := []string{}
+	err := db.Select(&jobIds, `SELECT id FROM import_jobs WHERE status NOT IN ('done', 'failed')`)
+	if err != nil {
+		return err
+	}
+
+	for _, jobId := range jobIds {
+		go func(jobId string) {
+			err := RunImportJob(db, jobId)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}(jobId)
+	}
+
+	return nil
+}
+
+func importItem(db *sqlx.DB, userId string, item ImportItem, tagIds map[string]string) error {
+	feed, err := AddUserFeed(db, userId, item.Url)
+
+	status := "added"
+	if errors.Is(err, ErrAlreadySubscribed) {
+		status = "exists"
+		err = nil
+	}
+
+	var choice *FeedChoiceError
+	if errors.As(err, &choice) {
+		urls := []string{}
+		for _, discovered := range choice.Feeds {
+			urls = append(urls, discovered.Url)
+		}
+		err = fmt.Errorf("the page offers several feeds: %s", strings.Join(urls, ", "))
+	}
+	if err != nil {
+		return finishImportItem(db, item, "failed", err.Error())
+	}
+
+	// Keep the name the outline gave the feed if it differs from its own
+	if status == "added" && item.Title != "" && !strings.EqualFold(item.Title, feed.Title) {
+		_, err = db.Exec(
+			`UPDATE user_feeds SET custom_title = $3 WHERE user_id = $1 AND feed_id = $2`,
+			userId,
+			feed.Id,
+			item.Title,
+		)
+		if err != nil {
+			return finishImportItem(db, item, "failed", err.Error())
+		}
+	}
+
+	for _, path := range item.Tags {
+		err = AddTagToFeed(db, feed.Id, tagIds[strings.Join(path, "\x00")])
+		if err != nil {
+			return finishImportItem(db, item, "failed", err.Error())
+		}
+	}
+
+	return finishImportItem(db, item, status, "")
+}
+
+func finishImportItem(db *sqlx.DB, item ImportItem, status string, message string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE import_items SET status = $2, error = $3 WHERE id = $1`,
+		item.Id,
+		status,
+		message,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE import_jobs SET
+			processed = processed + 1,
+			added = added + CASE WHEN $2 = 'added' THEN 1 ELSE 0 END,
+			existing = existing + CASE WHEN $2 = 'exists' THEN 1 ELSE 0 END,
+			failed = failed + CASE WHEN $2 = 'failed' THEN 1 ELSE 0 END
+		 WHERE id = $1`,
+		item.JobId,
+		status,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ensureTagPath returns the id of the tag at path, e.g. ["tech", "go"],
+// creating any tags along it that the user doesn't have yet.
+func ensureTagPath(db *sqlx.DB, userId string, path []string) (string, error) {
+	var parentId *string
+	for _, name := range path {
+		_, err := db.Exec(
+			`INSERT INTO tags (user_id, name, parent_id) VALUES ($1, $2, CAST($3 AS uuid))
+			 ON CONFLICT DO NOTHING`,
+			userId,
+			name,
+			parentId,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		var tagId string
+		err = db.Get(
+			&tagId,
+			`SELECT id FROM tags
+			 WHERE user_id = $1 AND name = $2 AND parent_id IS NOT DISTINCT FROM CAST($3 AS uuid)`,
+			userId,
+			name,
+			parentId,
+		)
+		if err != nil {
+			return "", err
+		}
+		parentId = &tagId
+	}
+
+	if parentId == nil {
+		return "", errors.New("empty tag path")
+	}
+
+	return *parentId, nil
+}
+
+func GetImportJob(db *sqlx.DB, userId string, jobId string) (ImportJob, error) {
+	job := ImportJob{}
+	err := db.Get(
+		&job,
+		`SELECT * FROM import_jobs WHERE id::text = $2 AND user_id = $1`,
+		userId,
+		jobId,
+	)
+
+	if err != nil {
+		return job, err
+	}
+
+	return job, nil
+}
+
+func GetImportItems(db *sqlx.DB, jobId string) ([]ImportItem, error) {
+	items := []ImportItem{}
+	err := db.Select(
+		&items,
+		`SELECT * FROM import_items WHERE job_id::text = $1 ORDER BY line ASC`,
+		jobId,
+	)
+
+	if err != nil {
+		return items, err
+	}
+
+	return items, nil
+}
+
+func GetUserImportJobs(db *sqlx.DB, userId string, limit int) ([]ImportJob, error) {
+	jobs := []ImportJob{}
+	err := db.Select(
+		&jobs,
+		`SELECT * FROM import_jobs WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		userId,
+		limit,
+	)
+
+	if err != nil {
+		return jobs, err
+	}
+
+	return jobs, nil
+}
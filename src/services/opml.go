@@ -0,0 +1,210 @@
+package services
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// OPMLFeed is a feed outline of an OPML document.
+type OPMLFeed struct {
+	// Line of the document the outline is on, for reporting problems
+	Line    int
+	Url     string
+	Title   string
+	SiteUrl string
+	// Tag paths from the folders the outline is nested in and its category
+	// attribute, e.g. [["tech", "go"], ["favorites"]]
+	Tags [][]string
+}
+
+type opmlDocument struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XmlUrl   string        `xml:"xmlUrl,attr,omitempty"`
+	HtmlUrl  string        `xml:"htmlUrl,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// WriteOPML writes feeds as an OPML 2.0 document. Every tag becomes a folder
+// outline nested like the tag itself, and a feed is listed under each of its
+// tags, or at the top level when it has none. The category attribute of a
+// feed names all its tags, e.g. "/tech/go,/favorites".
+func WriteOPML(w io.Writer, title string, tags []Tag, feeds []FeedWithTags) error {
+	paths := TagPaths(tags)
+
+	feedOutline := func(feed FeedWithTags) opmlOutline {
+		categories := []string{}
+		for _, tag := range feed.Tags {
+			if path, ok := paths[tag.Id]; ok {
+				categories = append(categories, "/"+path)
+			}
+		}
+
+		return opmlOutline{
+			Text:     feed.DisplayTitle(),
+			Title:    feed.DisplayTitle(),
+			Type:     "rss",
+			XmlUrl:   feed.Url,
+			HtmlUrl:  feed.SiteUrl,
+			Category: strings.Join(categories, ","),
+		}
+	}
+
+	var tagOutlines func(nodes []*TagNode) []opmlOutline
+	tagOutlines = func(nodes []*TagNode) []opmlOutline {
+		outlines := []opmlOutline{}
+		for _, node := range nodes {
+			outline := opmlOutline{Text: node.Name, Title: node.Name}
+			outline.Outlines = tagOutlines(node.Children)
+			for _, feed := range node.Feeds {
+				outline.Outlines = append(outline.Outlines, feedOutline(feed))
+			}
+			outlines = append(outlines, outline)
+		}
+
+		return outlines
+	}
+
+	document := opmlDocument{
+		Version: "2.0",
+		Title:   title,
+		Created: time.Now().UTC().Format(time.RFC1123Z),
+		Body:    tagOutlines(BuildTagTree(tags, feeds)),
+	}
+	for _, feed := range feeds {
+		if len(feed.Tags) == 0 {
+			document.Body = append(document.Body, feedOutline(feed))
+		}
+	}
+
+	return writeXML(w, document)
+}
+
+// ParseOPML reads the feed outlines of an OPML document. Outlines without an
+// xmlUrl are folders, whose names become tags of the feeds inside them.
+func ParseOPML(r io.Reader) ([]OPMLFeed, error) {
+	feeds := []OPMLFeed{}
+
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charset.NewReaderLabel
+	decoder.Strict = false
+
+	sawOPML := false
+	// Folder names of the outlines currently open, "" for feed outlines
+	folders := []string{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return feeds, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(element.Name.Local) {
+			case "opml":
+				sawOPML = true
+			case "outline":
+				line, _ := decoder.InputPos()
+				attrs := outlineAttributes(element)
+
+				if attrs["xmlurl"] == "" {
+					folders = append(folders, firstNonEmpty(attrs["title"], attrs["text"]))
+					continue
+				}
+
+				feeds = append(feeds, OPMLFeed{
+					Line:    line,
+					Url:     strings.TrimSpace(attrs["xmlurl"]),
+					Title:   firstNonEmpty(attrs["title"], attrs["text"]),
+					SiteUrl: strings.TrimSpace(attrs["htmlurl"]),
+					Tags:    outlineTags(folders, attrs["category"]),
+				})
+				folders = append(folders, "")
+			}
+		case xml.EndElement:
+			if strings.ToLower(element.Name.Local) == "outline" && len(folders) > 0 {
+				folders = folders[:len(folders)-1]
+			}
+		}
+	}
+
+	if !sawOPML {
+		return feeds, errors.New("not an OPML document")
+	}
+
+	return feeds, nil
+}
+
+func outlineAttributes(element xml.StartElement) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range element.Attr {
+		attrs[strings.ToLower(attr.Name.Local)] = strings.TrimSpace(attr.Value)
+	}
+
+	return attrs
+}
+
+// outlineTags combines the enclosing folders with the category attribute,
+// a comma separated list of slash delimited paths such as "/tech/go".
+func outlineTags(folders []string, category string) [][]string {
+	tags := [][]string{}
+	seen := map[string]bool{}
+
+	addPath := func(path []string) {
+		key := strings.ToLower(strings.Join(path, "\x00"))
+		if len(path) > 0 && !seen[key] {
+			tags = append(tags, path)
+			seen[key] = true
+		}
+	}
+
+	path := []string{}
+	for _, folder := range folders {
+		if folder != "" {
+			path = append(path, folder)
+		}
+	}
+	addPath(path)
+
+	// Exported files list a feed's tags both ways, so duplicates are dropped
+	for _, entry := range strings.Split(category, ",") {
+		path := []string{}
+		for _, name := range strings.Split(entry, "/") {
+			if name = strings.TrimSpace(name); name != "" {
+				path = append(path, name)
+			}
+		}
+		addPath(path)
+	}
+
+	return tags
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+// OutputFeed is an aggregated feed of a user's timeline that other readers
+// can subscribe to.
+type OutputFeed struct {
+	Title string
+	// Where this document is served from
+	SelfUrl string
+	// The page on this site showing the same items
+	HomeUrl string
+	Items   []FeedContentWithSource
+}
+
+// Updated is when the newest item of the feed was published or changed, or
+// the zero time for an empty feed.
+func (f OutputFeed) Updated() time.Time {
+	updated := time.Time{}
+	for _, item := range f.Items {
+		for _, value := range []string{item.CreatedAt, item.PublishedAt, stringValue(item.UpdatedAt)} {
+			if t := parseItemTime(value); t.After(updated) {
+				updated = t
+			}
+		}
+	}
+
+	return updated
+}
+
+// outputItem is an item as every output format needs it.
+type outputItem struct {
+	Id         string
+	Title      string
+	Link       string
+	Author     string
+	Summary    string
+	Content    string
+	Image      string
+	Categories []string
+	Published  time.Time
+	Updated    time.Time
+}
+
+func outputItems(feed OutputFeed) []outputItem {
+	items := []outputItem{}
+	for _, item := range feed.Items {
+		published := parseItemTime(item.PublishedAt)
+		updated := parseItemTime(stringValue(item.UpdatedAt))
+		if updated.Before(published) {
+			updated = published
+		}
+
+		// Credit the feed the item came from when it names no author
+		author := item.Author
+		if author == "" {
+			author = item.FeedTitle
+		}
+
+		items = append(items, outputItem{
+			Id:         "urn:uuid:" + item.Id,
+			Title:      item.Title,
+			Link:       item.Link,
+			Author:     author,
+			Summary:    SanitizeHTML(item.Summary, item.Link),
+			Content:    SanitizeHTML(item.Content, item.Link),
+			Image:      item.ImgUrl,
+			Categories: item.Categories,
+			Published:  published,
+			Updated:    updated,
+		})
+	}
+
+	return items
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Id         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Author     atomPerson     `xml:"author"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary"`
+	Content    *atomText      `xml:"content"`
+}
+
+// WriteAtom writes the feed as an Atom 1.0 document.
+func WriteAtom(w io.Writer, feed OutputFeed) error {
+	// Atom requires a date even when there are no entries
+	updated := feed.Updated()
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	document := atomFeed{
+		Id:      feed.SelfUrl,
+		Title:   feed.Title,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "RSS f33d"},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feed.SelfUrl},
+			{Rel: "alternate", Type: "text/html", Href: feed.HomeUrl},
+		},
+		Entries: []atomEntry{},
+	}
+
+	for _, item := range outputItems(feed) {
+		entry := atomEntry{
+			Id:         item.Id,
+			Title:      item.Title,
+			Updated:    item.Updated.UTC().Format(time.RFC3339),
+			Published:  item.Published.UTC().Format(time.RFC3339),
+			Author:     atomPerson{Name: item.Author},
+			Links:      []atomLink{{Rel: "alternate", Type: "text/html", Href: item.Link}},
+			Categories: []atomCategory{},
+		}
+		for _, category := range item.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: category})
+		}
+		if item.Summary != "" {
+			entry.Summary = &atomText{Type: "html", Body: item.Summary}
+		}
+		if item.Content != "" {
+			entry.Content = &atomText{Type: "html", Body: item.Content}
+		}
+		document.Entries = append(document.Entries, entry)
+	}
+
+	return writeXML(w, document)
+}
+
+type rssDocument struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomNS    string     `xml:"xmlns:atom,attr"`
+	ContentNS string     `xml:"xmlns:content,attr"`
+	DcNS      string     `xml:"xmlns:dc,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	SelfLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGuid struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Guid        rssGuid  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Creator     string   `xml:"dc:creator,omitempty"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description,omitempty"`
+	Content     string   `xml:"content:encoded,omitempty"`
+}
+
+// WriteRSS writes the feed as an RSS 2.0 document.
+func WriteRSS(w io.Writer, feed OutputFeed) error {
+	document := rssDocument{
+		Version:   "2.0",
+		AtomNS:    "http://www.w3.org/2005/Atom",
+		ContentNS: "http://purl.org/rss/1.0/modules/content/",
+		DcNS:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       feed.Title,
+			Link:        feed.HomeUrl,
+			Description: feed.Title,
+			SelfLink:    atomLink{Rel: "self", Type: "application/rss+xml", Href: feed.SelfUrl},
+			Items:       []rssItem{},
+		},
+	}
+	if updated := feed.Updated(); !updated.IsZero() {
+		document.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, item := range outputItems(feed) {
+		description := item.Summary
+		if description == "" {
+			description = item.Content
+		}
+
+		document.Channel.Items = append(document.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			Guid:        rssGuid{IsPermaLink: "false", Value: item.Id},
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+			Creator:     item.Author,
+			Categories:  item.Categories,
+			Description: description,
+			Content:     item.Content,
+		})
+	}
+
+	return writeXML(w, document)
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	Id            string           `json:"id"`
+	Url           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHtml   string           `json:"content_html"`
+	Summary       string           `json:"summary,omitempty"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+}
+
+// WriteJSONFeed writes the feed as a JSON Feed 1.1 document.
+func WriteJSONFeed(w io.Writer, feed OutputFeed) error {
+	document := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		HomePageUrl: feed.HomeUrl,
+		FeedUrl:     feed.SelfUrl,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range outputItems(feed) {
+		// Every item needs either content_html or content_text
+		content := item.Content
+		if content == "" {
+			content = item.Summary
+		}
+
+		entry := jsonFeedItem{
+			Id:            item.Id,
+			Url:           item.Link,
+			Title:         item.Title,
+			ContentHtml:   content,
+			Summary:       PlainText(item.Summary, 300),
+			Image:         item.Image,
+			DatePublished: item.Published.UTC().Format(time.RFC3339),
+			DateModified:  item.Updated.UTC().Format(time.RFC3339),
+			Tags:          item.Categories,
+		}
+		if item.Author != "" {
+			entry.Authors = []jsonFeedAuthor{{Name: item.Author}}
+		}
+		document.Items = append(document.Items, entry)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func writeXML(w io.Writer, document interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(document)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// parseItemTime reads a timestamp as the database returns it, giving the
+// zero time for anything else.
+func parseItemTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+
+	return *value
+}
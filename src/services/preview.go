@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// How many of the latest items a preview shows
+const previewLength = 10
+
+// FeedPreview describes a feed before anyone subscribes to it. Nothing about
+// it is stored.
+type FeedPreview struct {
+	Url         string                  `json:"url"`
+	Title       string                  `json:"title"`
+	Description string                  `json:"description"`
+	SiteLink    string                  `json:"siteLink"`
+	Items       []FeedContentWithSource `json:"items"`
+	ItemsPerDay float64                 `json:"itemsPerDay"`
+}
+
+// Frequency describes ItemsPerDay in words.
+func (p FeedPreview) Frequency() string {
+	switch {
+	case p.ItemsPerDay == 0:
+		return "unknown"
+	case p.ItemsPerDay >= 1:
+		return fmt.Sprintf("about %.0f posts per day", p.ItemsPerDay)
+	case p.ItemsPerDay*7 >= 1:
+		return fmt.Sprintf("about %.0f posts per week", p.ItemsPerDay*7)
+	default:
+		return fmt.Sprintf("about %.0f posts per month", p.ItemsPerDay*30)
+	}
+}
+
+// PreviewFeed fetches a feed, or discovers it from a web page the same way
+// AddUserFeed does, without writing anything to the database. It gives up
+// after the same timeout as AddUserFeed.
+func PreviewFeed(ctx context.Context, feedUrl string) (FeedPreview, error) {
+	preview := FeedPreview{}
+
+	ctx, cancel := context.WithTimeout(ctx, addFeedTimeout)
+	defer cancel()
+
+	feedUrl, err := NormalizeFeedUrl(feedUrl)
+	if err != nil {
+		return preview, err
+	}
+
+	fetched, err := fetchFeed(ctx, feedUrl, "", "")
+	if err == nil && (fetched.NotModified || fetched.Feed == nil) {
+		err = errUnexpectedNotModified
+	}
+	if err != nil {
+		discovered, _ := DiscoverFeeds(ctx, feedUrl)
+
+		switch len(discovered) {
+		case 0:
+			return preview, err
+		case 1:
+			feedUrl = discovered[0].Url
+			fetched, err = fetchFeed(ctx, feedUrl, "", "")
+			if err != nil {
+				return preview, err
+			}
+			if fetched.NotModified || fetched.Feed == nil {
+				return preview, errUnexpectedNotModified
+			}
+		default:
+			return preview, &FeedChoiceError{Feeds: discovered}
+		}
+	}
+
+	feed := fetched.Feed
+	items := make([]*gofeed.Item, len(feed.Items))
+	copy(items, feed.Items)
+
+	// Newest first, items without a date go last
+	sort.SliceStable(items, func(i, j int) bool {
+		return itemTime(items[i]).After(itemTime(items[j]))
+	})
+
+	preview.Url = feedUrl
+	preview.Title = feed.Title
+	preview.Description = feed.Description
+	preview.SiteLink = feed.Link
+	preview.ItemsPerDay = postingFrequency(items)
+	preview.Items = []FeedContentWithSource{}
+
+	// Relative links in the items resolve against the feed's own link
+	sorted := *feed
+	sorted.Items = items
+
+	for i, item := range getFeedContent(&sorted, "") {
+		if i == previewLength {
+			break
+		}
+
+		preview.Items = append(preview.Items, FeedContentWithSource{
+			FeedContent: FeedContent{
+				Guid:        item.Guid,
+				Title:       item.Title,
+				ImgUrl:      item.ImgUrl,
+				Link:        item.Link,
+				PublishedAt: item.PublishedAt,
+				Summary:     item.Summary,
+				Content:     item.Content,
+				Author:      item.Author,
+				Categories:  item.Categories,
+			},
+			FeedTitle: feed.Title,
+		})
+	}
+
+	return preview, nil
+}
+
+func itemTime(item *gofeed.Item) time.Time {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed
+	}
+
+	return time.Time{}
+}
+
+// postingFrequency estimates items per day from the dates of items sorted
+// newest first.
+func postingFrequency(items []*gofeed.Item) float64 {
+	dated := []time.Time{}
+	for _, item := range items {
+		if t := itemTime(item); !t.IsZero() {
+			dated = append(dated, t)
+		}
+	}
+
+	if len(dated) < 2 {
+		return 0
+	}
+
+	days := dated[0].Sub(dated[len(dated)-1]).Hours() / 24
+	if days <= 0 {
+		return 0
+	}
+
+	return float64(len(dated)-1) / days
+}
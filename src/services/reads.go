@@ -0,0 +1,68 @@
+package services
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Read state service functions
+
+func MarkItemRead(db *sqlx.DB, userId string, contentId string) error {
+	_, err := db.Exec(
+		`INSERT INTO user_item_reads (user_id, content_id)
+		 SELECT $1, fc.id FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id AND uf.user_id = $1)
+		 WHERE fc.id::text = $2
+		 ON CONFLICT DO NOTHING`,
+		userId,
+		contentId,
+	)
+
+	return err
+}
+
+func MarkItemUnread(db *sqlx.DB, userId string, contentId string) error {
+	_, err := db.Exec(
+		`DELETE FROM user_item_reads WHERE user_id = $1 AND content_id::text = $2`,
+		userId,
+		contentId,
+	)
+
+	return err
+}
+
+// MarkReadScope selects the items MarkAllRead applies to. Empty fields don't
+// narrow anything down, so the zero value covers everything the user follows.
+type MarkReadScope struct {
+	FeedId string
+	// Only items that arrived up to this time, so that items arriving while
+	// the user was reading stay unread. The zero time doesn't limit anything.
+	Before time.Time
+	// Only items from feeds matching a combination of tags
+	Tags TagFilter
+	// Only items matching a saved view's query, if set
+	View *ViewQuery
+}
+
+func MarkAllRead(db *sqlx.DB, userId string, scope MarkReadScope) error {
+	extraSql, extraArgs := ContentFilter{Tags: scope.Tags, View: scope.View}.extraSql(4)
+	var before *time.Time
+	if !scope.Before.IsZero() {
+		before = &scope.Before
+	}
+	args := append([]interface{}{userId, scope.FeedId, before}, extraArgs...)
+
+	_, err := db.Exec(
+		`INSERT INTO user_item_reads (user_id, content_id)
+		 SELECT $1, fc.id FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id AND uf.user_id = $1)
+		 WHERE ($2 = '' OR fc.feed_id::text = $2)
+		 AND (CAST($3 AS timestamptz) IS NULL OR fc.created_at <= $3)
+		 AND `+extraSql+`
+		 ON CONFLICT DO NOTHING`,
+		args...,
+	)
+
+	return err
+}
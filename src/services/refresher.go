@@ -0,0 +1,491 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type RefresherConfig struct {
+	// How often to look for feeds that are due for a fetch
+	Interval time.Duration
+	// Bounds for the per-feed polling interval
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Number of feeds fetched at the same time
+	Concurrency int
+	// Upper bound for downloading and parsing a single feed
+	FetchTimeout time.Duration
+	// Upper bound for the delay between retries of a failing feed
+	MaxBackoff time.Duration
+	// How long a feed may keep failing before it is considered dead
+	DeadAfter time.Duration
+}
+
+// Refresher periodically refreshes feeds in the background so that
+// timelines are current without anyone having to hit /update. Every feed
+// has its own schedule, adapted to how often it actually publishes.
+type Refresher struct {
+	db      *sqlx.DB
+	config  RefresherConfig
+	trigger chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewRefresher(db *sqlx.DB, config RefresherConfig) *Refresher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Refresher{
+		db:      db,
+		config:  config,
+		trigger: make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// Start runs a refresh immediately and then once every interval until Stop
+// is called.
+func (r *Refresher) Start() {
+	go r.run()
+}
+
+// Stop cancels any refresh in progress and waits for the loop to exit.
+func (r *Refresher) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+// Trigger asks the refresher to run a refresh as soon as possible. It never
+// blocks; triggers that arrive while one is already pending are dropped.
+func (r *Refresher) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Refresher) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.refresh()
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
+
+// refresh fetches every due feed using a bounded pool of workers. Each feed
+// is written in its own short transaction, so one slow host only ever holds
+// up its own worker.
+func (r *Refresher) refresh() {
+	feeds, err := GetDueFeeds(r.db)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	jobs := make(chan Feed)
+	var wg sync.WaitGroup
+
+	workers := r.config.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for feed := range jobs {
+				err := r.refreshFeed(feed)
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+	}
+
+	for _, feed := range feeds {
+		if r.ctx.Err() != nil {
+			break
+		}
+		jobs <- feed
+	}
+
+	close(jobs)
+	wg.Wait()
+}
+
+func (r *Refresher) refreshFeed(feed Feed) error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.FetchTimeout)
+	defer cancel()
+
+	fetched, err := fetchFeed(ctx, feed.Url, feed.Etag, feed.LastModified)
+
+	if err != nil {
+		return r.recordFailure(feed, fetched.StatusCode, err)
+	}
+
+	err = r.storeFeed(feed, fetched)
+
+	if err != nil {
+		return r.recordFailure(feed, fetched.StatusCode, err)
+	}
+
+	if fetched.MovedTo != "" {
+		movedTo, err := NormalizeFeedUrl(fetched.MovedTo)
+		if err != nil || movedTo == feed.Url {
+			return nil
+		}
+
+		fmt.Printf("Feed %s moved permanently to %s\n", feed.Id, movedTo)
+		return MoveFeed(r.db, feed.Id, movedTo)
+	}
+
+	return nil
+}
+
+// storeFeed writes the new items of a successful fetch, together with the
+// feed's health and schedule, in a single short transaction.
+func (r *Refresher) storeFeed(feed Feed, fetched fetchedFeed) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	itemsAdded := 0
+	itemRate := feed.ItemRate
+
+	if !fetched.NotModified {
+		newItemsToInsert := getFeedContent(fetched.Feed, feed.Id)
+
+		if len(newItemsToInsert) > 0 {
+			result, err := tx.NamedExec(
+				`INSERT INTO feed_content (feed_id, "guid", title, img_url, "link", published_at,
+				 	summary, content, author, categories, updated_at)
+				 VALUES (:feed_id, :guid, :title, :img_url, :link, CAST(NULLIF(:published_at, '') AS timestamptz),
+				 	:summary, :content, :author, :categories, CAST(NULLIF(:updated_at, '') AS timestamptz))
+				 ON CONFLICT DO NOTHING`,
+				newItemsToInsert,
+			)
+
+			if err != nil {
+				return err
+			}
+
+			inserted, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			itemsAdded = int(inserted)
+		}
+
+		err = updateFeedValidators(tx, feed.Id, fetched.Etag, fetched.LastModified)
+		if err != nil {
+			return err
+		}
+
+		err = updateFeedSiteUrl(tx, feed.Id, fetched.Feed.Link)
+		if err != nil {
+			return err
+		}
+
+		itemRate, err = updateItemRate(tx, feed.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Updated content for feed %s, added %d items\n", feed.Id, itemsAdded)
+
+	err = recordFetch(tx, feed.Id, fetched.StatusCode, "", itemsAdded)
+	if err != nil {
+		return err
+	}
+
+	err = scheduleFeed(tx, feed.Id, r.adaptInterval(itemRate, fetched.Hint))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordFailure stores a failed fetch, backs off exponentially and gives up
+// on feeds that are gone or have been failing for too long. It returns the
+// original error.
+func (r *Refresher) recordFailure(feed Feed, statusCode int, fetchErr error) error {
+	// Fetches cut short by Stop say nothing about the feed
+	if r.ctx.Err() != nil {
+		return fetchErr
+	}
+
+	err := recordFetch(r.db, feed.Id, statusCode, fetchErr.Error(), 0)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if statusCode == http.StatusGone {
+		err = markFeedDead(r.db, feed.Id, "The feed was removed by its publisher (410 Gone)")
+	} else {
+		err = markFeedDeadIfFailingSince(r.db, feed.Id, r.config.DeadAfter)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	err = backoffFeed(r.db, feed.Id, r.backoff(feed))
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return fmt.Errorf("refreshing feed %s: %w", feed.Id, fetchErr)
+}
+
+// backoff doubles the feed's usual interval for every failure after the
+// first one in a row.
+func (r *Refresher) backoff(feed Feed) time.Duration {
+	delay := time.Duration(feed.FetchInterval) * time.Second
+
+	for i := 0; i < feed.ConsecutiveFailures && delay < r.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > r.config.MaxBackoff {
+		delay = r.config.MaxBackoff
+	}
+
+	return delay
+}
+
+// adaptInterval picks a polling interval that should see about one new item
+// per fetch, but never polls more often than the publisher asked us to.
+func (r *Refresher) adaptInterval(itemsPerDay float64, hint time.Duration) time.Duration {
+	interval := r.config.MaxInterval
+	if itemsPerDay > 0 {
+		interval = time.Duration(float64(24*time.Hour) / itemsPerDay)
+	}
+
+	if interval < hint {
+		interval = hint
+	}
+
+	if interval < r.config.MinInterval {
+		interval = r.config.MinInterval
+	}
+
+	if interval > r.config.MaxInterval {
+		interval = r.config.MaxInterval
+	}
+
+	return interval
+}
+
+// Feed scheduling functions
+
+func GetDueFeeds(db *sqlx.DB) ([]Feed, error) {
+	feeds := []Feed{}
+	err := db.Select(
+		&feeds,
+		`SELECT * FROM feeds
+		 WHERE dead_at IS NULL AND next_fetch_at <= NOW()
+		 ORDER BY next_fetch_at ASC`,
+	)
+
+	if err != nil {
+		return feeds, err
+	}
+
+	return feeds, nil
+}
+
+// ExpediteUserFeeds makes every feed the user follows due for a fetch.
+func ExpediteUserFeeds(db *sqlx.DB, userId string) error {
+	_, err := db.Exec(
+		`UPDATE feeds SET next_fetch_at = NOW()
+		 WHERE id IN (SELECT feed_id FROM user_feeds WHERE user_id = $1)`,
+		userId,
+	)
+
+	return err
+}
+
+// updateItemRate stores the number of items per day the feed published over
+// the last two weeks.
+func updateItemRate(db sqlx.Ext, feedId string) (float64, error) {
+	var itemRate float64
+	err := sqlx.Get(
+		db,
+		&itemRate,
+		`UPDATE feeds SET item_rate = (
+			SELECT COUNT(*) / 14.0 FROM feed_content
+			WHERE feed_id = $1 AND published_at > NOW() - INTERVAL '14 days'
+		 )
+		 WHERE id = $1
+		 RETURNING item_rate`,
+		feedId,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return itemRate, nil
+}
+
+// ReviveFeed gives a dead feed another chance and fetches it right away.
+func ReviveFeed(db *sqlx.DB, feedId string) error {
+	_, err := db.Exec(
+		`UPDATE feeds SET
+			dead_at = NULL,
+			dead_reason = '',
+			consecutive_failures = 0,
+			failing_since = NULL,
+			next_fetch_at = NOW()
+		 WHERE id = $1`,
+		feedId,
+	)
+
+	return err
+}
+
+func markFeedDead(db sqlx.Execer, feedId string, reason string) error {
+	_, err := db.Exec(
+		"UPDATE feeds SET dead_at = NOW(), dead_reason = $2 WHERE id = $1",
+		feedId,
+		reason,
+	)
+
+	return err
+}
+
+func markFeedDeadIfFailingSince(db sqlx.Execer, feedId string, deadAfter time.Duration) error {
+	_, err := db.Exec(
+		`UPDATE feeds SET dead_at = NOW(), dead_reason = 'The feed has been failing since ' || failing_since::date
+		 WHERE id = $1 AND failing_since < NOW() - $2 * INTERVAL '1 second'`,
+		feedId,
+		int(deadAfter.Seconds()),
+	)
+
+	return err
+}
+
+// backoffFeed delays the next fetch without changing the feed's usual
+// interval.
+func backoffFeed(db sqlx.Execer, feedId string, delay time.Duration) error {
+	_, err := db.Exec(
+		"UPDATE feeds SET next_fetch_at = NOW() + $2 * INTERVAL '1 second' WHERE id = $1",
+		feedId,
+		int(delay.Seconds()),
+	)
+
+	return err
+}
+
+func scheduleFeed(db sqlx.Execer, feedId string, interval time.Duration) error {
+	_, err := db.Exec(
+		`UPDATE feeds
+		 SET fetch_interval = $2, next_fetch_at = NOW() + $2 * INTERVAL '1 second'
+		 WHERE id = $1`,
+		feedId,
+		int(interval.Seconds()),
+	)
+
+	return err
+}
+
+func updateFeedValidators(db sqlx.Execer, feedId string, etag string, lastModified string) error {
+	_, err := db.Exec(
+		"UPDATE feeds SET etag = $2, last_modified = $3 WHERE id = $1",
+		feedId,
+		etag,
+		lastModified,
+	)
+
+	return err
+}
+
+// updateFeedSiteUrl keeps the site a feed links to current, leaving it alone
+// when a fetch doesn't name one.
+func updateFeedSiteUrl(db sqlx.Execer, feedId string, siteUrl string) error {
+	if siteUrl == "" {
+		return nil
+	}
+
+	_, err := db.Exec(
+		`UPDATE feeds SET site_url = $2 WHERE id = $1 AND site_url <> $2`,
+		feedId,
+		siteUrl,
+	)
+
+	return err
+}
+
+// How many fetch attempts to keep for each feed
+const fetchHistoryLength = 50
+
+// recordFetch appends an attempt to the feed's fetch history and updates its
+// health summary. An empty fetchErr means the fetch succeeded.
+func recordFetch(db sqlx.Execer, feedId string, statusCode int, fetchErr string, itemsAdded int) error {
+	_, err := db.Exec(
+		`INSERT INTO feed_fetches (feed_id, status_code, error, items_added)
+		 VALUES ($1, $2, $3, $4)`,
+		feedId,
+		statusCode,
+		fetchErr,
+		itemsAdded,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`DELETE FROM feed_fetches WHERE feed_id = $1 AND id NOT IN (
+			SELECT id FROM feed_fetches WHERE feed_id = $1
+			ORDER BY attempted_at DESC
+			LIMIT $2
+		 )`,
+		feedId,
+		fetchHistoryLength,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`UPDATE feeds SET
+			last_attempt_at = NOW(),
+			last_status = $2,
+			last_error = $3,
+			last_items_added = $4,
+			last_success_at = CASE WHEN $3 = '' THEN NOW() ELSE last_success_at END,
+			consecutive_failures = CASE WHEN $3 = '' THEN 0 ELSE consecutive_failures + 1 END,
+			failing_since = CASE WHEN $3 = '' THEN NULL ELSE COALESCE(failing_since, NOW()) END
+		 WHERE id = $1`,
+		feedId,
+		statusCode,
+		fetchErr,
+		itemsAdded,
+	)
+
+	return err
+}
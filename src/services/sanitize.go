@@ -0,0 +1,327 @@
+package services
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Tags that are kept, together with the attributes allowed on them. Any
+// other tag is replaced by its children.
+var allowedTags = map[string][]string{
+	"a":          {"href"},
+	"abbr":       {},
+	"article":    {},
+	"audio":      {"src", "controls"},
+	"b":          {},
+	"blockquote": {"cite"},
+	"br":         {},
+	"caption":    {},
+	"cite":       {},
+	"code":       {},
+	"dd":         {},
+	"del":        {},
+	"details":    {},
+	"div":        {},
+	"dl":         {},
+	"dt":         {},
+	"em":         {},
+	"figcaption": {},
+	"figure":     {},
+	"h1":         {},
+	"h2":         {},
+	"h3":         {},
+	"h4":         {},
+	"h5":         {},
+	"h6":         {},
+	"hr":         {},
+	"i":          {},
+	"iframe":     {"src", "width", "height", "allowfullscreen"},
+	"img":        {"src", "alt", "width", "height"},
+	"ins":        {},
+	"kbd":        {},
+	"li":         {},
+	"mark":       {},
+	"ol":         {"start"},
+	"p":          {},
+	"pre":        {},
+	"q":          {"cite"},
+	"s":          {},
+	"section":    {},
+	"small":      {},
+	"source":     {"src", "type"},
+	"span":       {},
+	"strong":     {},
+	"sub":        {},
+	"summary":    {},
+	"sup":        {},
+	"table":      {},
+	"tbody":      {},
+	"td":         {"colspan", "rowspan"},
+	"tfoot":      {},
+	"th":         {"colspan", "rowspan"},
+	"thead":      {},
+	"tr":         {},
+	"u":          {},
+	"ul":         {},
+	"video":      {"src", "poster", "controls", "width", "height"},
+}
+
+// Attributes allowed on every kept tag
+var globalAttributes = []string{"title", "lang"}
+
+// Attributes holding URLs, which are made absolute and limited to safe schemes
+var urlAttributes = map[string]bool{
+	"href":   true,
+	"src":    true,
+	"cite":   true,
+	"poster": true,
+}
+
+// Tags that are removed together with everything inside them
+var droppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"form":     true,
+	"input":    true,
+	"button":   true,
+	"select":   true,
+	"textarea": true,
+	"svg":      true,
+	"math":     true,
+	"head":     true,
+	"title":    true,
+	"meta":     true,
+	"link":     true,
+	"base":     true,
+}
+
+// Hosts whose players may be embedded with an iframe
+var allowedIframeHosts = map[string]bool{
+	"www.youtube.com":          true,
+	"youtube.com":              true,
+	"www.youtube-nocookie.com": true,
+	"player.vimeo.com":         true,
+}
+
+// Hosts that only serve tracking pixels
+var trackerHosts = []string{
+	"feeds.feedburner.com",
+	"feedproxy.google.com",
+	"pixel.wp.com",
+	"stats.wordpress.com",
+	"www.google-analytics.com",
+	"doubleclick.net",
+	"pixel.quantserve.com",
+	"sb.scorecardresearch.com",
+}
+
+// SanitizeHTML cleans up publisher HTML so that it can be rendered as part
+// of our own pages. Only allowlisted tags and attributes are kept, scripts,
+// event handlers, unknown iframes and tracking pixels are removed, and
+// relative links and images are made absolute against baseUrl.
+func SanitizeHTML(fragment string, baseUrl string) string {
+	if strings.TrimSpace(fragment) == "" {
+		return ""
+	}
+
+	base := parseUrl(baseUrl)
+
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), context)
+	if err != nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, clean := range sanitizeNode(node, base) {
+			html.Render(&buf, clean)
+		}
+	}
+
+	return buf.String()
+}
+
+// sanitizeNode returns what node should be replaced with: nothing, itself
+// with cleaned attributes and children, or only its children.
+func sanitizeNode(node *html.Node, base *url.URL) []*html.Node {
+	switch node.Type {
+	case html.TextNode:
+		return []*html.Node{{Type: html.TextNode, Data: node.Data}}
+	case html.ElementNode:
+	default:
+		return nil
+	}
+
+	tag := strings.ToLower(node.Data)
+	if droppedTags[tag] {
+		return nil
+	}
+
+	children := []*html.Node{}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, sanitizeNode(child, base)...)
+	}
+
+	allowed, ok := allowedTags[tag]
+	if !ok {
+		return children
+	}
+
+	attrs := sanitizeAttributes(node.Attr, allowed, base)
+
+	switch tag {
+	case "iframe":
+		src, ok := attribute(attrs, "src")
+		if !ok || !isAllowedIframe(src) {
+			return nil
+		}
+		attrs = append(attrs, html.Attribute{Key: "sandbox", Val: "allow-scripts allow-same-origin allow-presentation"})
+	case "img":
+		src, ok := attribute(attrs, "src")
+		if !ok || isTrackingPixel(src, attrs) {
+			return nil
+		}
+		attrs = append(attrs, html.Attribute{Key: "loading", Val: "lazy"})
+	case "a":
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer nofollow"},
+		)
+	}
+
+	clean := &html.Node{
+		Type:     html.ElementNode,
+		Data:     tag,
+		DataAtom: atom.Lookup([]byte(tag)),
+		Attr:     attrs,
+	}
+	for _, child := range children {
+		clean.AppendChild(child)
+	}
+
+	return []*html.Node{clean}
+}
+
+func sanitizeAttributes(attrs []html.Attribute, allowed []string, base *url.URL) []html.Attribute {
+	clean := []html.Attribute{}
+
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !(contains(allowed, key) || contains(globalAttributes, key)) {
+			continue
+		}
+
+		value := attr.Val
+		if urlAttributes[key] {
+			resolved, ok := resolveUrl(value, base)
+			if !ok {
+				continue
+			}
+			value = resolved
+		}
+
+		clean = append(clean, html.Attribute{Key: key, Val: value})
+	}
+
+	return clean
+}
+
+// resolveUrl makes a URL absolute and only lets through http, https and
+// mailto links.
+func resolveUrl(value string, base *url.URL) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return "", false
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		// Still relative because there was no base to resolve against
+		return u.String(), u.Host == "" && !strings.HasPrefix(u.Path, "//")
+	}
+
+	return "", false
+}
+
+func isAllowedIframe(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+
+	return allowedIframeHosts[strings.ToLower(u.Hostname())]
+}
+
+func isTrackingPixel(src string, attrs []html.Attribute) bool {
+	width, _ := attribute(attrs, "width")
+	height, _ := attribute(attrs, "height")
+	if isTiny(width) || isTiny(height) {
+		return true
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, tracker := range trackerHosts {
+		if host == tracker || strings.HasSuffix(host, "."+tracker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTiny(dimension string) bool {
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(dimension), "px"))
+	return err == nil && size <= 1
+}
+
+func attribute(attrs []html.Attribute, key string) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+
+	return "", false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseUrl parses an absolute URL, returning nil for anything else.
+func parseUrl(rawUrl string) *url.URL {
+	u, err := url.Parse(rawUrl)
+	if err != nil || !u.IsAbs() {
+		return nil
+	}
+
+	return u
+}
@@ -0,0 +1,145 @@
+package services
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	const base = "https://example.com/posts/1"
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"plain markup is kept",
+			`<p>Hello <strong>world</strong></p>`,
+			`<p>Hello <strong>world</strong></p>`,
+		},
+		{
+			"empty input",
+			"  \n ",
+			"",
+		},
+		{
+			"scripts are removed with their content",
+			`<p>before</p><script>alert(1)</script><p>after</p>`,
+			`<p>before</p><p>after</p>`,
+		},
+		{
+			"styles and forms are removed with their content",
+			`<style>p { color: red }</style><form><input name="q"><button>Go</button></form>text`,
+			`text`,
+		},
+		{
+			"unknown tags are replaced by their children",
+			`<custom-tag><em>kept</em></custom-tag>`,
+			`<em>kept</em>`,
+		},
+		{
+			"event handlers and style attributes are dropped",
+			`<p onclick="alert(1)" style="color: red" title="t">x</p>`,
+			`<p title="t">x</p>`,
+		},
+		{
+			"javascript links lose their href",
+			`<a href="javascript:alert(1)">click</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">click</a>`,
+		},
+		{
+			"javascript links are caught regardless of case and whitespace",
+			`<a href="  JaVaScRiPt:alert(1)">click</a>`,
+			`<a target="_blank" rel="noopener noreferrer nofollow">click</a>`,
+		},
+		{
+			"data URLs are not allowed as image sources",
+			`<img src="data:image/svg+xml;base64,PHN2Zz4=">`,
+			``,
+		},
+		{
+			"relative links are resolved against the base",
+			`<a href="/about">About</a>`,
+			`<a href="https://example.com/about" target="_blank" rel="noopener noreferrer nofollow">About</a>`,
+		},
+		{
+			"mailto links are kept",
+			`<a href="mailto:me@example.com">mail</a>`,
+			`<a href="mailto:me@example.com" target="_blank" rel="noopener noreferrer nofollow">mail</a>`,
+		},
+		{
+			"relative images are resolved and lazy loaded",
+			`<img src="pic.png" alt="A picture">`,
+			`<img src="https://example.com/posts/pic.png" alt="A picture" loading="lazy"/>`,
+		},
+		{
+			"allowed iframes are sandboxed",
+			`<iframe src="https://www.youtube.com/embed/abc" width="560" height="315" onload="x()"></iframe>`,
+			`<iframe src="https://www.youtube.com/embed/abc" width="560" height="315" sandbox="allow-scripts allow-same-origin allow-presentation"></iframe>`,
+		},
+		{
+			"iframes from other hosts are removed",
+			`<iframe src="https://evil.example.net/embed"></iframe>`,
+			``,
+		},
+		{
+			"iframes over plain http are removed",
+			`<iframe src="http://www.youtube.com/embed/abc"></iframe>`,
+			``,
+		},
+		{
+			"iframes without a source are removed",
+			`<iframe></iframe>`,
+			``,
+		},
+		{
+			"one pixel images are removed",
+			`<p>text<img src="https://example.com/p.gif" width="1" height="1"></p>`,
+			`<p>text</p>`,
+		},
+		{
+			"pixel sizes given in px are recognized",
+			`<img src="https://example.com/p.gif" width="0px">`,
+			``,
+		},
+		{
+			"images from tracker hosts are removed",
+			`<img src="https://pixel.wp.com/g.gif?blog=1">`,
+			``,
+		},
+		{
+			"images from subdomains of tracker hosts are removed",
+			`<img src="https://ad.doubleclick.net/pixel">`,
+			``,
+		},
+		{
+			"images on hosts that merely end like a tracker are kept",
+			`<img src="https://notdoubleclick.net/photo.jpg">`,
+			`<img src="https://notdoubleclick.net/photo.jpg" loading="lazy"/>`,
+		},
+	}
+
+	for _, test := range tests {
+		got := SanitizeHTML(test.in, base)
+		if got != test.want {
+			t.Errorf("%s:\nSanitizeHTML(%q)\n got %q\nwant %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeHTMLWithoutBase(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		// Relative links stay relative when there's nothing to resolve against
+		{`<img src="pic.png">`, `<img src="pic.png" loading="lazy"/>`},
+		// Protocol relative URLs would point at another host
+		{`<img src="//evil.example.net/pic.png">`, ``},
+	}
+
+	for _, test := range tests {
+		got := SanitizeHTML(test.in, "")
+		if got != test.want {
+			t.Errorf("SanitizeHTML(%q, \"\") = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
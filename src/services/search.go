@@ -0,0 +1,130 @@
+package services
+
+import (
+	"html"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Search service types and functions
+
+type SearchQuery struct {
+	// Web search style query, e.g. `golang -gopher "release notes"`
+	Query string
+	// Only items from feeds with this tag, or "*" for every feed
+	TagId string
+	// Only items from this feed, or "" for every feed
+	FeedId string
+	// Only items published within this range of dates, either may be ""
+	From string
+	To   string
+}
+
+type SearchResult struct {
+	FeedContentWithSource
+	Rank float64 `json:"rank"`
+	// Matching fragments of the item text, with matches between
+	// snippetStart and snippetStop. Use HighlightSnippet to render it.
+	Snippet string `json:"snippet"`
+}
+
+const (
+	snippetStart = "{{{"
+	snippetStop  = "}}}"
+)
+
+func SearchContent(db *sqlx.DB, userId string, query SearchQuery, page int, pageSize int) ([]SearchResult, error) {
+	results := []SearchResult{}
+	err := db.Select(
+		&results,
+		`SELECT fc.id, fc.feed_id, fc.guid, fc.title, fc.img_url, fc.link, fc.created_at,
+			 COALESCE(fc.published_at, fc.created_at) as published_at,
+			 fc.summary, fc.author,
+			 `+feedTitleSql+` as feed_title,
+			 EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+			 ) as is_read,
+			 EXISTS (
+			 	SELECT 1 FROM starred_items s WHERE s.user_id = $1 AND s.content_id = fc.id
+			 ) as is_starred,
+			 ts_rank(fc.search_vector, websearch_to_tsquery('english', $2)) as rank,
+			 ts_headline(
+			 	'english',
+			 	regexp_replace(fc.summary || ' ' || fc.content, '<[^>]*>', ' ', 'g'),
+			 	websearch_to_tsquery('english', $2),
+			 	'StartSel="`+snippetStart+`", StopSel="`+snippetStop+`", MaxFragments=2, MaxWords=25, MinWords=10'
+			 ) as snippet
+			 FROM feed_content fc
+			 INNER JOIN feeds f ON (f.id = fc.feed_id)
+			 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
+			 WHERE `+searchFilterSql+`
+			 ORDER BY rank DESC, COALESCE(fc.published_at, fc.created_at) DESC
+			 LIMIT $7 OFFSET $8`,
+		userId,
+		query.Query,
+		query.TagId,
+		query.FeedId,
+		query.From,
+		query.To,
+		pageSize,
+		(page-1)*pageSize,
+	)
+
+	if err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+func SearchContentCount(db *sqlx.DB, userId string, query SearchQuery) (int, error) {
+	var count int
+	err := db.Get(
+		&count,
+		`SELECT COUNT(*)
+		 	FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
+		 WHERE `+searchFilterSql,
+		userId,
+		query.Query,
+		query.TagId,
+		query.FeedId,
+		query.From,
+		query.To,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// searchFilterSql applies a SearchQuery given as $1 user id, $2 query, $3
+// tag id, $4 feed id, $5 from and $6 to, to feed_content fc joined with
+// user_feeds uf.
+var searchFilterSql = `uf.user_id = $1
+	AND fc.search_vector @@ websearch_to_tsquery('english', $2)
+	AND (
+		CASE WHEN $3 = '*' THEN TRUE
+		ELSE EXISTS (
+			SELECT 1 FROM feed_tags ft
+			INNER JOIN tags t ON (ft.tag_id = t.id AND t.user_id = $1)
+			WHERE ft.feed_id = fc.feed_id AND t.id IN ` + tagSubtreeSql("id::text = $3") + `
+		)
+		END
+	)
+	AND ($4 = '' OR fc.feed_id::text = $4)
+	AND ($5 = '' OR COALESCE(fc.published_at, fc.created_at) >= $5::date)
+	AND ($6 = '' OR COALESCE(fc.published_at, fc.created_at) < $6::date + 1)`
+
+// HighlightSnippet turns a search snippet into HTML, with the matches
+// wrapped in <mark> and everything else escaped.
+func HighlightSnippet(snippet string) string {
+	escaped := html.EscapeString(html.UnescapeString(snippet))
+	escaped = strings.ReplaceAll(escaped, snippetStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, snippetStop, "</mark>")
+
+	return escaped
+}
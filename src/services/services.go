@@ -1,12 +1,19 @@
 package services
 
 import (
+	"context"
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/mmcdole/gofeed"
 )
 
@@ -15,6 +22,8 @@ type User struct {
 	Id           string `json:"id"`
 	LastActiveAt string `db:"last_active_at" json:"lastActiveAt"`
 	CreatedAt    string `db:"created_at" json:"createdAt"`
+	// Secret part of the URLs of the user's output feeds
+	FeedToken string `db:"feed_token" json:"-"`
 }
 
 func GetUser(db *sqlx.DB, id string) (User, error) {
@@ -42,12 +51,59 @@ func UpdateActive(db *sqlx.DB, id string) error {
 	return err
 }
 
+func GetUserByFeedToken(db *sqlx.DB, feedToken string) (User, error) {
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM users WHERE feed_token = $1", feedToken)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// ResetFeedToken gives the user a new feed token, so that the URLs of their
+// output feeds handed out so far stop working.
+func ResetFeedToken(db *sqlx.DB, id string) error {
+	_, err := db.Exec("UPDATE users SET feed_token = DEFAULT WHERE id = $1", id)
+	return err
+}
+
 // Feed service types and functions
 type Feed struct {
-	Id        string `json:"id"`
-	Url       string `json:"url"`
-	Title     string `json:"title"`
-	CreatedAt string `db:"created_at" json:"createdAt"`
+	Id            string  `json:"id"`
+	Url           string  `json:"url"`
+	Title         string  `json:"title"`
+	SiteUrl       string  `db:"site_url" json:"siteUrl"`
+	CreatedAt     string  `db:"created_at" json:"createdAt"`
+	NextFetchAt   string  `db:"next_fetch_at" json:"nextFetchAt"`
+	FetchInterval int     `db:"fetch_interval" json:"fetchInterval"`
+	ItemRate      float64 `db:"item_rate" json:"itemRate"`
+	Etag          string  `json:"etag"`
+	LastModified  string  `db:"last_modified" json:"lastModified"`
+	FeedHealth
+}
+
+// FeedHealth is the outcome of the most recent fetches of a feed.
+type FeedHealth struct {
+	LastAttemptAt       *string `db:"last_attempt_at" json:"lastAttemptAt"`
+	LastSuccessAt       *string `db:"last_success_at" json:"lastSuccessAt"`
+	LastStatus          int     `db:"last_status" json:"lastStatus"`
+	LastError           string  `db:"last_error" json:"lastError"`
+	LastItemsAdded      int     `db:"last_items_added" json:"lastItemsAdded"`
+	ConsecutiveFailures int     `db:"consecutive_failures" json:"consecutiveFailures"`
+	FailingSince        *string `db:"failing_since" json:"failingSince"`
+	DeadAt              *string `db:"dead_at" json:"deadAt"`
+	DeadReason          string  `db:"dead_reason" json:"deadReason"`
+}
+
+// FeedFetch is a single attempt at fetching a feed.
+type FeedFetch struct {
+	Id          string `json:"id"`
+	FeedId      string `db:"feed_id" json:"feedId"`
+	AttemptedAt string `db:"attempted_at" json:"attemptedAt"`
+	StatusCode  int    `db:"status_code" json:"statusCode"`
+	Error       string `json:"error"`
+	ItemsAdded  int    `db:"items_added" json:"itemsAdded"`
 }
 
 type NewFeedBody struct {
@@ -73,42 +129,159 @@ func GetUserFeeds(db *sqlx.DB, userId string) ([]Feed, error) {
 	return feeds, nil
 }
 
-func getRssFeedTitle(feedUrl string) (string, error) {
-	parser := gofeed.NewParser()
-	feed, err := parser.ParseURL(feedUrl)
+func GetUserFeed(db *sqlx.DB, userId string, feedId string) (Feed, error) {
+	feed := Feed{}
+	err := db.Get(
+		&feed, `
+		SELECT
+			feeds.*
+		FROM feeds
+		INNER JOIN user_feeds uf ON (uf.feed_id = feeds.id)
+		WHERE uf.user_id = $1 AND feeds.id = $2`,
+		userId,
+		feedId,
+	)
 
 	if err != nil {
-		return "", err
+		return feed, err
 	}
 
-	return feed.Title, nil
+	return feed, nil
 }
 
+func GetFeedFetches(db *sqlx.DB, feedId string, limit int) ([]FeedFetch, error) {
+	fetches := []FeedFetch{}
+	err := db.Select(
+		&fetches,
+		`SELECT * FROM feed_fetches WHERE feed_id = $1
+		 ORDER BY attempted_at DESC
+		 LIMIT $2`,
+		feedId,
+		limit,
+	)
+
+	if err != nil {
+		return fetches, err
+	}
+
+	return fetches, nil
+}
+
+// addFeedTimeout bounds the requests made while subscribing to a feed.
+const addFeedTimeout = 30 * time.Second
+
+// errUnexpectedNotModified is returned when a server answers a fetch made
+// without validators as if the feed was cached, leaving nothing to parse.
+var errUnexpectedNotModified = errors.New("the server answered 304 Not Modified without being asked")
+
+// getRssFeedInfo returns the title of a feed and the site it belongs to.
+func getRssFeedInfo(feedUrl string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), addFeedTimeout)
+	defer cancel()
+
+	fetched, err := fetchFeed(ctx, feedUrl, "", "")
+
+	if err != nil {
+		return "", "", err
+	}
+	if fetched.NotModified || fetched.Feed == nil {
+		return "", "", errUnexpectedNotModified
+	}
+
+	return fetched.Feed.Title, fetched.Feed.Link, nil
+}
+
+var ErrAlreadySubscribed = errors.New("already subscribed to this feed")
+
+// AddUserFeed subscribes the user to a feed. When the URL isn't a feed but a
+// regular web page, the feed is discovered from the page; if the page offers
+// several feeds a *FeedChoiceError lists them.
 func AddUserFeed(db *sqlx.DB, userId string, feedUrl string) (Feed, error) {
-	feed := Feed{}
+	return addUserFeed(db, userId, feedUrl, true)
+}
 
-	feedTitle, err := getRssFeedTitle(feedUrl)
+func addUserFeed(db *sqlx.DB, userId string, feedUrl string, discover bool) (Feed, error) {
+	feed := Feed{}
 
+	feedUrl, err := NormalizeFeedUrl(feedUrl)
 	if err != nil {
 		return feed, err
 	}
 
-	err = db.Get(
-		&feed, `
-		WITH feed_insert AS (
-			INSERT INTO feeds (url, title) VALUES ($1, $2)
-			ON CONFLICT DO NOTHING
-			RETURNING *
-		), new_feed AS (
-			SELECT * FROM feeds WHERE url = $1
-		), usr_feed AS (
-			INSERT INTO user_feeds (user_id, feed_id)
-			VALUES ($3, COALESCE((SELECT id FROM feed_insert), (SELECT id FROM new_feed)))
+	feed, err = findFeedByUrl(db, feedUrl)
+
+	if err == sql.ErrNoRows {
+		feedTitle, siteUrl, err := getRssFeedInfo(feedUrl)
+		if err != nil && discover {
+			ctx, cancel := context.WithTimeout(context.Background(), addFeedTimeout)
+			discovered, _ := DiscoverFeeds(ctx, feedUrl)
+			cancel()
+
+			switch len(discovered) {
+			case 0:
+				return feed, err
+			case 1:
+				return addUserFeed(db, userId, discovered[0].Url, false)
+			default:
+				return feed, &FeedChoiceError{Feeds: discovered}
+			}
+		}
+		if err != nil {
+			return feed, err
+		}
+
+		// Another subscriber may have added the same feed in the meantime
+		err = db.Get(
+			&feed,
+			`INSERT INTO feeds (url, title, site_url) VALUES ($1, $2, $3)
+			 ON CONFLICT (url) DO UPDATE SET url = feeds.url
+			 RETURNING *`,
+			feedUrl,
+			feedTitle,
+			siteUrl,
 		)
-		SELECT * FROM feed_insert UNION SELECT * FROM new_feed nf`,
-		feedUrl,
-		feedTitle,
+
+		if err != nil {
+			return feed, err
+		}
+	} else if err != nil {
+		return feed, err
+	}
+
+	result, err := db.Exec(
+		`INSERT INTO user_feeds (user_id, feed_id) VALUES ($1, $2)
+		 ON CONFLICT DO NOTHING`,
 		userId,
+		feed.Id,
+	)
+
+	if err != nil {
+		return feed, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return feed, err
+	}
+
+	if inserted == 0 {
+		return feed, ErrAlreadySubscribed
+	}
+
+	return feed, nil
+}
+
+// findFeedByUrl looks up a feed by its normalized URL, treating the http and
+// https versions of a URL, with or without a trailing slash, as the same feed.
+func findFeedByUrl(db *sqlx.DB, feedUrl string) (Feed, error) {
+	feed := Feed{}
+	err := db.Get(
+		&feed,
+		`SELECT * FROM feeds WHERE url = ANY($2)
+		 ORDER BY url = $1 DESC
+		 LIMIT 1`,
+		feedUrl,
+		pq.Array(feedUrlVariants(feedUrl)),
 	)
 
 	if err != nil {
@@ -132,35 +305,178 @@ func DeleteUserFeed(db *sqlx.DB, userId string, feedId string) error {
 	return nil
 }
 
+// MoveFeed points a feed at its new location. If another feed already lives
+// there, the two are merged into that one: subscriptions, tags and items move
+// over without creating duplicates, and the old feed is removed.
+func MoveFeed(db *sqlx.DB, feedId string, newUrl string) error {
+	newUrl, err := NormalizeFeedUrl(newUrl)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var targetId string
+	err = tx.Get(&targetId, "SELECT id FROM feeds WHERE url = $1 AND id <> $2", newUrl, feedId)
+
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("UPDATE feeds SET url = $2 WHERE id = $1", feedId, newUrl)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range mergeFeedStatements(feedId, targetId) {
+		_, err = tx.Exec(statement.sql, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+type sqlStatement struct {
+	sql  string
+	args []interface{}
+}
+
+// mergeFeedStatements moves everything of one feed over to another and
+// removes it. Each statement gets only the arguments it uses, as lib/pq
+// rejects extra ones.
+func mergeFeedStatements(feedId string, targetId string) []sqlStatement {
+	both := []interface{}{feedId, targetId}
+	source := []interface{}{feedId}
+
+	return []sqlStatement{
+		{`INSERT INTO user_feeds (user_id, feed_id, custom_title, paused, subscribed_at, note)
+		 SELECT user_id, $2, custom_title, paused, subscribed_at, note FROM user_feeds WHERE feed_id = $1
+		 ON CONFLICT DO NOTHING`, both},
+		{`DELETE FROM user_feeds WHERE feed_id = $1`, source},
+		{`INSERT INTO feed_tags (feed_id, tag_id)
+		 SELECT $2, tag_id FROM feed_tags WHERE feed_id = $1
+		 ON CONFLICT DO NOTHING`, both},
+		{`DELETE FROM feed_tags WHERE feed_id = $1`, source},
+		// Item guids are unique, so the target can't already have these items
+		{`UPDATE feed_content SET feed_id = $2 WHERE feed_id = $1`, both},
+		{`UPDATE starred_items SET feed_id = $2 WHERE feed_id = $1`, both},
+		{`DELETE FROM feeds WHERE id = $1`, source},
+	}
+}
+
+// MergeDuplicateFeeds normalizes the URLs of feeds added before URLs were
+// normalized, and merges feeds whose URLs only differ in scheme, case or a
+// trailing slash into the oldest of them. A feed that can't be moved is
+// logged and left as it is.
+func MergeDuplicateFeeds(db *sqlx.DB) error {
+	feeds := []Feed{}
+	err := db.Select(&feeds, "SELECT * FROM feeds ORDER BY created_at")
+	if err != nil {
+		return err
+	}
+
+	// URL of the feed kept for each key
+	kept := map[string]string{}
+	for _, feed := range feeds {
+		normalized, err := NormalizeFeedUrl(feed.Url)
+		if err != nil {
+			continue
+		}
+
+		key := feedUrlKey(normalized)
+		keptUrl, ok := kept[key]
+		if !ok {
+			kept[key] = feed.Url
+			keptUrl = normalized
+		}
+		if keptUrl == feed.Url {
+			continue
+		}
+
+		err = MoveFeed(db, feed.Id, keptUrl)
+		if err != nil {
+			fmt.Printf("Failed to merge feed %s into %s: %v\n", feed.Id, keptUrl, err)
+			continue
+		}
+		if !ok {
+			kept[key] = normalized
+		}
+	}
+
+	return nil
+}
+
 // Tag service types and functions
 type Tag struct {
-	Id        string `json:"id"`
-	UserId    string `db:"user_id" json:"userId"`
-	Name      string `json:"name"`
-	CreatedAt string `db:"created_at" json:"createdAt"`
+	Id        string  `json:"id"`
+	UserId    string  `db:"user_id" json:"userId"`
+	Name      string  `json:"name"`
+	CreatedAt string  `db:"created_at" json:"createdAt"`
+	ParentId  *string `db:"parent_id" json:"parentId"`
+	// CSS color such as #3366cc, or "" for the default
+	Color string `json:"color"`
+	// Order among the tag's siblings
+	Position int `json:"position"`
+	// Names from the top level tag down to this one, e.g. "tech/go". Only
+	// set on lists of all of a user's tags.
+	Path string `db:"-" json:"path,omitempty"`
+}
+
+type TagWithUnread struct {
+	Tag
+	UnreadCount int `db:"unread_count" json:"unreadCount"`
 }
 
 // Content service types and functions
 type FeedContent struct {
-	Id          string `json:"id"`
-	FeedId      string `json:"feedId" db:"feed_id"`
-	Guid        string `json:"guid"`
-	Title       string `json:"title"`
-	ImgUrl      string `db:"img_url" json:"imgUrl"`
-	Link        string `json:"link"`
-	CreatedAt   string `db:"created_at" json:"createdAt"`
-	PublishedAt string `db:"published_at" json:"publishedAt"`
+	Id          string         `json:"id"`
+	FeedId      string         `json:"feedId" db:"feed_id"`
+	Guid        string         `json:"guid"`
+	Title       string         `json:"title"`
+	ImgUrl      string         `db:"img_url" json:"imgUrl"`
+	Link        string         `json:"link"`
+	CreatedAt   string         `db:"created_at" json:"createdAt"`
+	PublishedAt string         `db:"published_at" json:"publishedAt"`
+	Summary     string         `json:"summary"`
+	Content     string         `json:"content"`
+	Author      string         `json:"author"`
+	Categories  pq.StringArray `json:"categories"`
+	UpdatedAt   *string        `db:"updated_at" json:"updatedAt"`
 }
 
 type FeedContentWithSource struct {
 	FeedContent
 	FeedTitle string `db:"feed_title" json:"feedTitle"`
+	IsRead    bool   `db:"is_read" json:"isRead"`
+	IsStarred bool   `db:"is_starred" json:"isStarred"`
 }
 
 // Extended feed type with tags
 type FeedWithTags struct {
 	Feed
-	Tags TagsArray `json:"tags" db:"tags"`
+	Tags         TagsArray    `json:"tags" db:"tags"`
+	UnreadCount  int          `db:"unread_count" json:"unreadCount"`
+	Subscription Subscription `db:"subscription" json:"subscription"`
+}
+
+// DisplayTitle is the user's custom title for the feed, or else the
+// publisher's.
+func (f FeedWithTags) DisplayTitle() string {
+	if f.Subscription.CustomTitle != "" {
+		return f.Subscription.CustomTitle
+	}
+
+	return f.Title
 }
 
 // TagsArray is a custom type that can scan JSON arrays into []Tag
@@ -212,6 +528,11 @@ type NewFeedContent struct {
 	ImgUrl      string `db:"img_url"`
 	Link        string
 	PublishedAt string `db:"published_at"`
+	Summary     string
+	Content     string
+	Author      string
+	Categories  pq.StringArray
+	UpdatedAt   string `db:"updated_at"`
 }
 
 type UpdateableContent struct {
@@ -219,30 +540,120 @@ type UpdateableContent struct {
 	Url    string `json:"url"`
 }
 
-func GetContent(db *sqlx.DB, userId string, page int, pageSize int, tagId string) ([]FeedContentWithSource, error) {
+// ContentFilter narrows down the items GetContent returns.
+type ContentFilter struct {
+	// Only items the user hasn't read yet
+	UnreadOnly bool
+	// Only items from feeds matching a combination of tags
+	Tags TagFilter
+	// Only items matching a saved view's query, if set
+	View *ViewQuery
+}
+
+// TagFilter combines several tags. Empty fields don't narrow anything down.
+type TagFilter struct {
+	// Items from feeds with any of these tags, or with all of them when
+	// MatchAll is set. A tag includes the tags nested under it.
+	Include  []string
+	MatchAll bool
+	// No items from feeds with any of these tags
+	Exclude []string
+	// Only items from feeds the user hasn't tagged at all
+	Untagged bool
+}
+
+// extraSql returns the conditions of the filter's tag combination and view,
+// with their arguments numbered from firstArg.
+func (f ContentFilter) extraSql(firstArg int) (string, []interface{}) {
+	tagsSql, args := f.Tags.extraSql("fc.feed_id", firstArg)
+	if f.View == nil {
+		return tagsSql, args
+	}
+
+	viewSql, viewArgs := f.View.sql(firstArg + len(args))
+	return tagsSql + " AND " + viewSql, append(args, viewArgs...)
+}
+
+// extraSql returns the conditions of the tag combination for items whose
+// feed id is in feedIdColumn, with their arguments numbered from firstArg.
+// The user id has to be $1.
+func (f TagFilter) extraSql(feedIdColumn string, firstArg int) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(firstArg+len(args)-1)
+	}
+
+	if len(f.Include) > 0 {
+		include := param(pq.Array(f.Include))
+		if f.MatchAll {
+			conditions = append(conditions, `NOT EXISTS (
+				SELECT 1 FROM unnest(CAST(`+include+` AS text[])) AS wanted(id)
+				WHERE NOT EXISTS (
+					SELECT 1 FROM feed_tags ft
+					WHERE ft.feed_id = `+feedIdColumn+` AND ft.tag_id IN `+tagSubtreeSql("id::text = wanted.id")+`
+				)
+			)`)
+		} else {
+			conditions = append(conditions, `EXISTS (
+				SELECT 1 FROM feed_tags ft
+				WHERE ft.feed_id = `+feedIdColumn+` AND ft.tag_id IN `+tagSubtreeSql("id::text = ANY("+include+")")+`
+			)`)
+		}
+	}
+
+	if len(f.Exclude) > 0 {
+		conditions = append(conditions, `NOT EXISTS (
+			SELECT 1 FROM feed_tags ft
+			WHERE ft.feed_id = `+feedIdColumn+` AND ft.tag_id IN `+tagSubtreeSql("id::text = ANY("+param(pq.Array(f.Exclude))+")")+`
+		)`)
+	}
+
+	if f.Untagged {
+		conditions = append(conditions, `NOT EXISTS (
+			SELECT 1 FROM feed_tags ft
+			INNER JOIN tags t ON (ft.tag_id = t.id AND t.user_id = $1)
+			WHERE ft.feed_id = `+feedIdColumn+`
+		)`)
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE", nil
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+func GetContent(db *sqlx.DB, userId string, page int, pageSize int, filter ContentFilter) ([]FeedContentWithSource, error) {
 	feedContent := []FeedContentWithSource{}
+	extraSql, extraArgs := filter.extraSql(5)
+	args := append([]interface{}{
+		userId,
+		filter.UnreadOnly,
+		pageSize,
+		(page - 1) * pageSize,
+	}, extraArgs...)
+
 	err := db.Select(
 		&feedContent,
 		`SELECT fc.id, fc.feed_id, fc.guid, fc.title, fc.img_url, fc.link, fc.created_at,
 			 COALESCE(fc.published_at, fc.created_at) as published_at,
-			 f.title as feed_title
+			 fc.summary, fc.content, fc.author, fc.categories, fc.updated_at,
+			 `+feedTitleSql+` as feed_title,
+			 EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+			 ) as is_read,
+			 EXISTS (
+			 	SELECT 1 FROM starred_items s WHERE s.user_id = $1 AND s.content_id = fc.id
+			 ) as is_starred
 			 FROM feed_content fc
 			 INNER JOIN feeds f ON (f.id = fc.feed_id)
 			 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
-		 	 LEFT JOIN feed_tags ft ON (ft.feed_id = uf.feed_id)
-		  	 LEFT JOIN tags t ON (ft.tag_id = t.id and t.user_id = $1)
-		 	 WHERE (
-		 	 	CASE WHEN $4 = '*' THEN TRUE
-		 	 	ELSE t.id = $4::uuid
-		 	 	END
-		 	 ) AND
-		 	 uf.user_id = $1
+		 	 WHERE `+contentFilterSql+` AND `+extraSql+`
 			 ORDER BY COALESCE(fc.published_at, fc.created_at) DESC
-			 LIMIT $2 OFFSET $3`,
-		userId,
-		pageSize,
-		(page-1)*pageSize,
-		tagId,
+			 LIMIT $3 OFFSET $4`,
+		args...,
 	)
 
 	if err != nil {
@@ -252,23 +663,18 @@ func GetContent(db *sqlx.DB, userId string, page int, pageSize int, tagId string
 	return feedContent, nil
 }
 
-func GetContentCount(db *sqlx.DB, userId string, tagId string) (int, error) {
+func GetContentCount(db *sqlx.DB, userId string, filter ContentFilter) (int, error) {
 	var count int
+	extraSql, extraArgs := filter.extraSql(3)
+	args := append([]interface{}{userId, filter.UnreadOnly}, extraArgs...)
+
 	err := db.Get(
 		&count,
 		`SELECT COUNT(*)
 		 	FROM feed_content fc
 		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
-		 LEFT JOIN feed_tags ft ON (ft.feed_id = uf.feed_id)
-		 LEFT JOIN tags t ON (ft.tag_id = t.id and t.user_id = $1)
-		 WHERE (
-		 	CASE WHEN $2 = '*' THEN TRUE
-		 	ELSE t.id = $2::uuid
-		 	END
-		 ) AND
-		 uf.user_id = $1`,
-		userId,
-		tagId,
+		 WHERE `+contentFilterSql+` AND `+extraSql,
+		args...,
 	)
 
 	if err != nil {
@@ -278,22 +684,115 @@ func GetContentCount(db *sqlx.DB, userId string, tagId string) (int, error) {
 	return count, nil
 }
 
-func getFeedContent(feedUrl string, feedId string) ([]NewFeedContent, error) {
-	parser := gofeed.NewParser()
-	feed, err := parser.ParseURL(feedUrl)
+func GetItem(db *sqlx.DB, userId string, itemId string) (FeedContentWithSource, error) {
+	item := FeedContentWithSource{}
+	err := db.Get(
+		&item,
+		`SELECT fc.id, fc.feed_id, fc.guid, fc.title, COALESCE(fc.img_url, '') as img_url, fc.link, fc.created_at,
+			 COALESCE(fc.published_at, fc.created_at) as published_at,
+			 fc.summary, fc.content, fc.author, fc.categories, fc.updated_at,
+			 `+feedTitleSql+` as feed_title,
+			 EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+			 ) as is_read,
+			 EXISTS (
+			 	SELECT 1 FROM starred_items s WHERE s.user_id = $1 AND s.content_id = fc.id
+			 ) as is_starred
+			 FROM feed_content fc
+			 INNER JOIN feeds f ON (f.id = fc.feed_id)
+			 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id AND uf.user_id = $1)
+			 WHERE fc.id::text = $2`,
+		userId,
+		itemId,
+	)
+
+	if err != nil {
+		return item, err
+	}
+
+	return item, nil
+}
+
+// GetAdjacentItems returns the ids of the items before and after the given
+// one in the user's timeline, as filtered by filter. Either may be empty.
+func GetAdjacentItems(db *sqlx.DB, userId string, item FeedContentWithSource, filter ContentFilter) (string, string, error) {
+	var newer, older []string
+	extraSql, extraArgs := filter.extraSql(5)
+	args := append([]interface{}{
+		userId,
+		filter.UnreadOnly,
+		item.PublishedAt,
+		item.Id,
+	}, extraArgs...)
+
+	err := db.Select(
+		&newer,
+		`SELECT fc.id FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
+		 WHERE `+contentFilterSql+` AND `+extraSql+`
+		 AND (COALESCE(fc.published_at, fc.created_at), fc.id) > ($3::timestamptz, $4::uuid)
+		 ORDER BY COALESCE(fc.published_at, fc.created_at) ASC, fc.id ASC
+		 LIMIT 1`,
+		args...,
+	)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	err = db.Select(
+		&older,
+		`SELECT fc.id FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
+		 WHERE `+contentFilterSql+` AND `+extraSql+`
+		 AND (COALESCE(fc.published_at, fc.created_at), fc.id) < ($3::timestamptz, $4::uuid)
+		 ORDER BY COALESCE(fc.published_at, fc.created_at) DESC, fc.id DESC
+		 LIMIT 1`,
+		args...,
+	)
 
 	if err != nil {
-		return []NewFeedContent{}, err
+		return "", "", err
 	}
 
+	previous, next := "", ""
+	if len(newer) > 0 {
+		previous = newer[0]
+	}
+	if len(older) > 0 {
+		next = older[0]
+	}
+
+	return previous, next, nil
+}
+
+// contentFilterSql applies a ContentFilter given as $1 user id and $2 unread
+// only, to feed_content fc joined with user_feeds uf. Paused subscriptions
+// are left out.
+var contentFilterSql = `uf.user_id = $1 AND uf.paused = FALSE AND (
+		$2 = FALSE OR NOT EXISTS (
+			SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+		)
+	)`
+
+func getFeedContent(feed *gofeed.Feed, feedId string) []NewFeedContent {
 	newItems := []NewFeedContent{}
 	for _, item := range feed.Items {
+		// Relative URLs in the item are relative to the item, or else the feed
+		baseUrl := item.Link
+		if baseUrl == "" {
+			baseUrl = feed.Link
+		}
+
 		imgUrl := ""
 		if item.Image != nil {
 			imgUrl = item.Image.URL
 		} else if len(item.Enclosures) > 0 {
 			imgUrl = item.Enclosures[0].URL
 		}
+		if imgUrl != "" {
+			imgUrl, _ = resolveUrl(imgUrl, parseUrl(baseUrl))
+		}
 
 		// Extract publication date, preferring Published over Updated
 		publishedAt := ""
@@ -303,6 +802,24 @@ func getFeedContent(feedUrl string, feedId string) ([]NewFeedContent, error) {
 			publishedAt = item.Updated
 		}
 
+		updatedAt := ""
+		if item.UpdatedParsed != nil {
+			updatedAt = item.UpdatedParsed.Format(time.RFC3339)
+		}
+
+		author := ""
+		if item.Author != nil {
+			author = item.Author.Name
+			if author == "" {
+				author = item.Author.Email
+			}
+		}
+
+		categories := pq.StringArray{}
+		if item.Categories != nil {
+			categories = item.Categories
+		}
+
 		newItems = append(
 			newItems,
 			NewFeedContent{
@@ -312,52 +829,53 @@ func getFeedContent(feedUrl string, feedId string) ([]NewFeedContent, error) {
 				ImgUrl:      imgUrl,
 				Link:        item.Link,
 				PublishedAt: publishedAt,
+				Summary:     SanitizeHTML(item.Description, baseUrl),
+				Content:     SanitizeHTML(item.Content, baseUrl),
+				Author:      author,
+				Categories:  categories,
+				UpdatedAt:   updatedAt,
 			},
 		)
 	}
 
-	return newItems, nil
+	return newItems
 }
 
-func UpdateUserContent(db *sqlx.DB, userId string) error {
-	userFeeds, err := GetUserFeeds(db, userId)
-
-	if err != nil {
-		return err
-	}
+// Tag service functions
 
-	tx, err := db.Beginx()
+func GetUserTags(db *sqlx.DB, userId string) ([]Tag, error) {
+	tags := []Tag{}
+	err := db.Select(
+		&tags,
+		`SELECT * FROM tags WHERE user_id = $1 ORDER BY position ASC, name ASC`,
+		userId,
+	)
 
 	if err != nil {
-		return err
-	}
-
-	for _, feed := range userFeeds {
-		newItemsToInsert, _ := getFeedContent(feed.Url, feed.Id)
-		fmt.Printf("Updating content for feed %s, found %d items\n", feed.Id, len(newItemsToInsert))
-		tx.NamedExec(
-			`INSERT INTO feed_content (feed_id, "guid", title, img_url, "link", published_at)
-			 VALUES (:feed_id, :guid, :title, :img_url, :link, :published_at) ON CONFLICT DO NOTHING`,
-			newItemsToInsert,
-		)
+		return tags, err
 	}
 
-	err = tx.Commit()
-
-	if err != nil {
-		return err
-	}
+	setTagPaths(tags)
+	SortTagsByPath(tags)
 
-	return nil
+	return tags, nil
 }
 
-// Tag service functions
-
-func GetUserTags(db *sqlx.DB, userId string) ([]Tag, error) {
-	tags := []Tag{}
+func GetUserTagsWithUnread(db *sqlx.DB, userId string) ([]TagWithUnread, error) {
+	tags := []TagWithUnread{}
 	err := db.Select(
 		&tags,
-		`SELECT * FROM tags WHERE user_id = $1 ORDER BY name ASC`,
+		`SELECT t.*,
+			(SELECT COUNT(*) FROM feed_content fc
+			 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id AND uf.user_id = $1 AND uf.paused = FALSE)
+			 WHERE EXISTS (
+			 	SELECT 1 FROM feed_tags ft
+			 	WHERE ft.feed_id = fc.feed_id AND ft.tag_id IN `+tagSubtreeSql("id = t.id")+`
+			 ) AND NOT EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+			 )
+			) as unread_count
+		 FROM tags t WHERE t.user_id = $1 ORDER BY t.position ASC, t.name ASC`,
 		userId,
 	)
 
@@ -365,17 +883,33 @@ func GetUserTags(db *sqlx.DB, userId string) ([]Tag, error) {
 		return tags, err
 	}
 
+	plain := []Tag{}
+	for _, tag := range tags {
+		plain = append(plain, tag.Tag)
+	}
+	paths := TagPaths(plain)
+	keys := tagSortKeys(plain)
+	for i := range tags {
+		tags[i].Path = paths[tags[i].Id]
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return keys[tags[i].Id] < keys[tags[j].Id]
+	})
+
 	return tags, nil
 }
 
-func CreateTag(db *sqlx.DB, userId string, name string) (Tag, error) {
+// CreateTag adds a tag, nested under parentId unless it is "".
+func CreateTag(db *sqlx.DB, userId string, name string, parentId string) (Tag, error) {
 	tag := Tag{}
 	err := db.Get(
 		&tag,
-		`INSERT INTO tags (user_id, name) VALUES ($1, $2)
+		`INSERT INTO tags (user_id, name, parent_id)
+		 VALUES ($1, $2, (SELECT id FROM tags WHERE id::text = $3 AND user_id = $1))
 		 RETURNING *`,
 		userId,
 		name,
+		parentId,
 	)
 
 	if err != nil {
@@ -385,18 +919,45 @@ func CreateTag(db *sqlx.DB, userId string, name string) (Tag, error) {
 	return tag, nil
 }
 
-func DeleteTag(db *sqlx.DB, userId string, tagId string) error {
-	_, err := db.Exec(
-		`DELETE FROM tags WHERE id = $1 AND user_id = $2`,
-		tagId,
-		userId,
-	)
+// DeleteTag removes a tag and detaches it from its feeds. The tags nested
+// under it are deleted as well when deleteChildren is set, and otherwise
+// move up to the tag's parent.
+func DeleteTag(db *sqlx.DB, userId string, tagId string, deleteChildren bool) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if deleteChildren {
+		_, err = tx.Exec(
+			`DELETE FROM tags WHERE id IN `+tagSubtreeSql("id::text = $2"),
+			userId,
+			tagId,
+		)
+	} else {
+		_, err = tx.Exec(
+			`UPDATE tags SET parent_id = (SELECT parent_id FROM tags WHERE id::text = $2 AND user_id = $1)
+			 WHERE parent_id::text = $2 AND user_id = $1`,
+			userId,
+			tagId,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`DELETE FROM tags WHERE id = $1 AND user_id = $2`,
+			tagId,
+			userId,
+		)
+	}
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func GetFeedTags(db *sqlx.DB, feedId string) ([]Tag, error) {
@@ -451,19 +1012,26 @@ func GetUserFeedsWithTags(db *sqlx.DB, userId string) ([]FeedWithTags, error) {
 		&feeds,
 		`SELECT 
 			f.*,
+			`+subscriptionColumns+`,
 			COALESCE(
 				(SELECT json_agg(t) FROM (
-					SELECT t.id, t.user_id, t.name, t.created_at 
+					SELECT t.id, t.user_id, t.name, t.created_at, t.color, t.position
 					FROM tags t 
 					INNER JOIN feed_tags ft ON ft.tag_id = t.id 
 					WHERE ft.feed_id = f.id AND t.user_id = $1
+					ORDER BY t.position ASC, t.name ASC
 				) t),
 				'[]'::json
-			) as tags
+			) as tags,
+			(SELECT COUNT(*) FROM feed_content fc
+			 WHERE fc.feed_id = f.id AND NOT EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id
+			 )
+			) as unread_count
 		FROM feeds f
 		INNER JOIN user_feeds uf ON (uf.feed_id = f.id)
 		WHERE uf.user_id = $1
-		ORDER BY f.title ASC`,
+		ORDER BY `+feedTitleSql+` ASC`,
 		userId,
 	)
 
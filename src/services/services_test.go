@@ -0,0 +1,50 @@
+package services
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMergeFeedStatements(t *testing.T) {
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+
+	statements := mergeFeedStatements("source-id", "target-id")
+	for _, statement := range statements {
+		highest := 0
+		for _, match := range placeholder.FindAllStringSubmatch(statement.sql, -1) {
+			n, _ := strconv.Atoi(match[1])
+			if n > highest {
+				highest = n
+			}
+		}
+
+		if highest != len(statement.args) {
+			t.Errorf("statement uses %d parameters but gets %d arguments: %s", highest, len(statement.args), statement.sql)
+		}
+		if len(statement.args) > 0 && statement.args[0] != "source-id" {
+			t.Errorf("$1 should be the merged feed, got %v: %s", statement.args[0], statement.sql)
+		}
+		if len(statement.args) > 1 && statement.args[1] != "target-id" {
+			t.Errorf("$2 should be the target feed, got %v: %s", statement.args[1], statement.sql)
+		}
+	}
+
+	// Everything pointing at the old feed has to move before it's removed
+	last := statements[len(statements)-1].sql
+	if !strings.HasPrefix(last, "DELETE FROM feeds") {
+		t.Errorf("the merged feed should be removed last, got: %s", last)
+	}
+	for _, table := range []string{"user_feeds", "feed_tags", "feed_content", "starred_items"} {
+		moved := false
+		for _, statement := range statements {
+			if strings.Contains(statement.sql, table) && strings.Contains(statement.sql, "$2") {
+				moved = true
+			}
+		}
+		if !moved {
+			t.Errorf("rows of %s are not moved to the target feed", table)
+		}
+	}
+}
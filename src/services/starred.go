@@ -0,0 +1,90 @@
+package services
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Starred items service types and functions
+
+// StarredItem is a starred copy of a feed item. Id is empty once the original
+// item no longer exists.
+type StarredItem struct {
+	FeedContentWithSource
+	StarId    string `db:"star_id" json:"starId"`
+	StarredAt string `db:"starred_at" json:"starredAt"`
+}
+
+func StarItem(db *sqlx.DB, userId string, contentId string) error {
+	_, err := db.Exec(
+		`INSERT INTO starred_items (user_id, content_id, feed_id, "guid", title, "link", img_url, feed_title, published_at)
+		 SELECT $1, fc.id, fc.feed_id, fc.guid, fc.title, fc.link, COALESCE(fc.img_url, ''), `+feedTitleSql+`,
+		 	COALESCE(fc.published_at, fc.created_at)
+		 FROM feed_content fc
+		 INNER JOIN feeds f ON (f.id = fc.feed_id)
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id AND uf.user_id = $1)
+		 WHERE fc.id::text = $2
+		 ON CONFLICT DO NOTHING`,
+		userId,
+		contentId,
+	)
+
+	return err
+}
+
+// UnstarItem removes a star, given either the starred item's id or the id of
+// the original item.
+func UnstarItem(db *sqlx.DB, userId string, id string) error {
+	_, err := db.Exec(
+		`DELETE FROM starred_items
+		 WHERE user_id = $1 AND (id::text = $2 OR content_id::text = $2)`,
+		userId,
+		id,
+	)
+
+	return err
+}
+
+func GetStarredItems(db *sqlx.DB, userId string, page int, pageSize int, tags TagFilter) ([]StarredItem, error) {
+	items := []StarredItem{}
+	tagsSql, tagsArgs := tags.extraSql("s.feed_id", 4)
+	args := append([]interface{}{userId, pageSize, (page - 1) * pageSize}, tagsArgs...)
+
+	err := db.Select(
+		&items,
+		`SELECT COALESCE(s.content_id::text, '') as id, COALESCE(s.feed_id::text, '') as feed_id,
+			 s.guid, s.title, s.img_url, s.link, s.starred_at as created_at, s.published_at,
+			 s.feed_title, TRUE as is_starred, s.id as star_id, s.starred_at,
+			 EXISTS (
+			 	SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = s.content_id
+			 ) as is_read
+			 FROM starred_items s
+			 WHERE s.user_id = $1 AND `+tagsSql+`
+			 ORDER BY s.starred_at DESC
+			 LIMIT $2 OFFSET $3`,
+		args...,
+	)
+
+	if err != nil {
+		return items, err
+	}
+
+	return items, nil
+}
+
+func GetStarredCount(db *sqlx.DB, userId string, tags TagFilter) (int, error) {
+	var count int
+	tagsSql, tagsArgs := tags.extraSql("s.feed_id", 2)
+	args := append([]interface{}{userId}, tagsArgs...)
+
+	err := db.Get(
+		&count,
+		`SELECT COUNT(*) FROM starred_items s WHERE s.user_id = $1 AND `+tagsSql,
+		args...,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Subscription service types and functions
+
+// Subscription is a user following a feed, with the user's own settings
+// for it.
+type Subscription struct {
+	Id     string `json:"id"`
+	UserId string `db:"user_id" json:"userId"`
+	FeedId string `db:"feed_id" json:"feedId"`
+	// Shown instead of the publisher's title when set
+	CustomTitle string `db:"custom_title" json:"customTitle"`
+	// Hides the feed's items from the timeline without unsubscribing
+	Paused       bool   `json:"paused"`
+	SubscribedAt string `db:"subscribed_at" json:"subscribedAt"`
+	Note         string `json:"note"`
+}
+
+// SubscriptionSettings are the parts of a subscription the user can change.
+type SubscriptionSettings struct {
+	CustomTitle string `json:"customTitle"`
+	Paused      bool   `json:"paused"`
+	Note        string `json:"note"`
+}
+
+// subscriptionColumns selects the subscription uf into a struct field
+// tagged db:"subscription".
+const subscriptionColumns = `uf.id AS "subscription.id",
+	uf.user_id AS "subscription.user_id",
+	uf.feed_id AS "subscription.feed_id",
+	uf.custom_title AS "subscription.custom_title",
+	uf.paused AS "subscription.paused",
+	uf.subscribed_at AS "subscription.subscribed_at",
+	uf.note AS "subscription.note"`
+
+// feedTitleSql is the title user_feeds uf shows for feeds f.
+const feedTitleSql = `COALESCE(NULLIF(uf.custom_title, ''), f.title)`
+
+func GetSubscription(db *sqlx.DB, userId string, feedId string) (Subscription, error) {
+	subscription := Subscription{}
+	err := db.Get(
+		&subscription,
+		"SELECT * FROM user_feeds WHERE user_id = $1 AND feed_id::text = $2",
+		userId,
+		feedId,
+	)
+
+	if err != nil {
+		return subscription, err
+	}
+
+	return subscription, nil
+}
+
+func UpdateSubscription(db *sqlx.DB, userId string, feedId string, settings SubscriptionSettings) error {
+	result, err := db.Exec(
+		`UPDATE user_feeds SET custom_title = $3, paused = $4, note = $5
+		 WHERE user_id = $1 AND feed_id::text = $2`,
+		userId,
+		feedId,
+		settings.CustomTitle,
+		settings.Paused,
+		settings.Note,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("subscription not found")
+	}
+
+	return nil
+}
+
+func SetSubscriptionPaused(db *sqlx.DB, userId string, feedId string, paused bool) error {
+	_, err := db.Exec(
+		"UPDATE user_feeds SET paused = $3 WHERE user_id = $1 AND feed_id::text = $2",
+		userId,
+		feedId,
+		paused,
+	)
+
+	return err
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TagNode is a tag together with the tags nested under it and the feeds
+// tagged with it.
+type TagNode struct {
+	Tag
+	Children []*TagNode     `json:"children"`
+	Feeds    []FeedWithTags `json:"feeds"`
+}
+
+// BuildTagTree nests tags under their parents and sorts feeds under the tags
+// they have. Tags whose parent isn't in the list become roots, and siblings
+// keep the order they were given in.
+func BuildTagTree(tags []Tag, feeds []FeedWithTags) []*TagNode {
+	nodes := map[string]*TagNode{}
+	for _, tag := range tags {
+		nodes[tag.Id] = &TagNode{Tag: tag, Children: []*TagNode{}, Feeds: []FeedWithTags{}}
+	}
+
+	for _, feed := range feeds {
+		for _, tag := range feed.Tags {
+			if node, ok := nodes[tag.Id]; ok {
+				node.Feeds = append(node.Feeds, feed)
+			}
+		}
+	}
+
+	roots := []*TagNode{}
+	for _, tag := range tags {
+		node := nodes[tag.Id]
+		if tag.ParentId != nil {
+			if parent, ok := nodes[*tag.ParentId]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+
+	return roots
+}
+
+// TagPaths maps tag ids to their full path, e.g. "tech/go".
+func TagPaths(tags []Tag) map[string]string {
+	paths := map[string]string{}
+	for id, chain := range tagAncestry(tags) {
+		names := []string{}
+		for _, tag := range chain {
+			names = append(names, tag.Name)
+		}
+		paths[id] = strings.Join(names, "/")
+	}
+
+	return paths
+}
+
+// SortTagsByPath orders tags depth first, so that every tag directly
+// follows its parent and siblings are in their custom order.
+func SortTagsByPath(tags []Tag) {
+	keys := tagSortKeys(tags)
+	sort.SliceStable(tags, func(i, j int) bool {
+		return keys[tags[i].Id] < keys[tags[j].Id]
+	})
+}
+
+func setTagPaths(tags []Tag) {
+	paths := TagPaths(tags)
+	for i := range tags {
+		tags[i].Path = paths[tags[i].Id]
+	}
+}
+
+// tagSortKeys maps tag ids to keys that sort tags depth first. Each level
+// sorts by position and then name, and levels are joined with a separator
+// that sorts before any character, so that "tech/go" comes before
+// "tech-news".
+func tagSortKeys(tags []Tag) map[string]string {
+	keys := map[string]string{}
+	for id, chain := range tagAncestry(tags) {
+		levels := []string{}
+		for _, tag := range chain {
+			levels = append(levels, fmt.Sprintf("%010d %s", tag.Position, strings.ToLower(tag.Name)))
+		}
+		keys[id] = strings.Join(levels, "\x00")
+	}
+
+	return keys
+}
+
+// tagAncestry maps tag ids to the tags from their top level tag down to
+// themselves.
+func tagAncestry(tags []Tag) map[string][]Tag {
+	byId := map[string]Tag{}
+	for _, tag := range tags {
+		byId[tag.Id] = tag
+	}
+
+	ancestry := map[string][]Tag{}
+	for _, tag := range tags {
+		chain := []Tag{tag}
+		seen := map[string]bool{tag.Id: true}
+
+		for parentId := tag.ParentId; parentId != nil && !seen[*parentId]; {
+			parent, ok := byId[*parentId]
+			if !ok {
+				break
+			}
+			chain = append([]Tag{parent}, chain...)
+			seen[parent.Id] = true
+			parentId = parent.ParentId
+		}
+
+		ancestry[tag.Id] = chain
+	}
+
+	return ancestry
+}
+
+// GetTag returns one of the user's tags with its path filled in.
+func GetTag(db *sqlx.DB, userId string, tagId string) (Tag, error) {
+	tags, err := GetUserTags(db, userId)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	for _, tag := range tags {
+		if tag.Id == tagId {
+			return tag, nil
+		}
+	}
+
+	return Tag{}, sql.ErrNoRows
+}
+
+// GetTagChildren returns the tags nested directly under a tag.
+func GetTagChildren(db *sqlx.DB, userId string, tagId string) ([]Tag, error) {
+	tags := []Tag{}
+	err := db.Select(
+		&tags,
+		`SELECT * FROM tags WHERE user_id = $1 AND parent_id::text = $2 ORDER BY name ASC`,
+		userId,
+		tagId,
+	)
+
+	if err != nil {
+		return tags, err
+	}
+
+	return tags, nil
+}
+
+// SetTagParent moves a tag under another one, or to the top level when
+// parentId is "". A tag can't be moved under itself or its descendants.
+func SetTagParent(db sqlx.Ext, userId string, tagId string, parentId string) error {
+	if parentId == "" {
+		_, err := db.Exec(
+			`UPDATE tags SET parent_id = NULL WHERE id::text = $2 AND user_id = $1`,
+			userId,
+			tagId,
+		)
+		return err
+	}
+
+	var isDescendant bool
+	err := sqlx.Get(
+		db,
+		&isDescendant,
+		`SELECT $3 IN (SELECT id::text FROM `+tagSubtreeSql("id::text = $2")+` AS subtree)`,
+		userId,
+		tagId,
+		parentId,
+	)
+	if err != nil {
+		return err
+	}
+	if isDescendant {
+		return errors.New("a tag can't be nested under itself")
+	}
+
+	result, err := db.Exec(
+		`UPDATE tags SET parent_id = p.id
+		 FROM tags p
+		 WHERE tags.id::text = $2 AND tags.user_id = $1
+		 AND p.id::text = $3 AND p.user_id = $1`,
+		userId,
+		tagId,
+		parentId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("tag not found")
+	}
+
+	return nil
+}
+
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// ValidateTagColor accepts "" for no color or a hex color such as #3366cc.
+func ValidateTagColor(color string) error {
+	if color != "" && !tagColorPattern.MatchString(color) {
+		return fmt.Errorf("%q is not a color like #3366cc", color)
+	}
+
+	return nil
+}
+
+// UpdateTag renames a tag and sets its color, which is either "" or a hex
+// color such as #3366cc.
+func UpdateTag(db sqlx.Ext, userId string, tagId string, name string, color string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("a tag needs a name")
+	}
+	if err := ValidateTagColor(color); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		`UPDATE tags SET name = $3, color = $4 WHERE id::text = $2 AND user_id = $1`,
+		userId,
+		tagId,
+		strings.TrimSpace(name),
+		strings.ToLower(color),
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("tag not found")
+	}
+
+	return nil
+}
+
+// MoveTagAmongSiblings moves a tag one place up (offset -1) or down (offset
+// 1) among the tags sharing its parent.
+func MoveTagAmongSiblings(db *sqlx.DB, userId string, tagId string, offset int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	siblings := []Tag{}
+	err = tx.Select(
+		&siblings,
+		`SELECT * FROM tags
+		 WHERE user_id = $1
+		 AND parent_id IS NOT DISTINCT FROM (SELECT parent_id FROM tags WHERE id::text = $2 AND user_id = $1)
+		 ORDER BY position ASC, name ASC`,
+		userId,
+		tagId,
+	)
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, tag := range siblings {
+		if tag.Id == tagId {
+			index = i
+		}
+	}
+	if index == -1 {
+		return errors.New("tag not found")
+	}
+
+	other := index + offset
+	if other < 0 || other >= len(siblings) {
+		return nil
+	}
+	siblings[index], siblings[other] = siblings[other], siblings[index]
+
+	// Number every sibling, as they all start out at the same position
+	for position, tag := range siblings {
+		_, err = tx.Exec(
+			`UPDATE tags SET position = $1 WHERE id = $2`,
+			position,
+			tag.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MergeTag moves the feeds and nested tags of one tag onto another and then
+// deletes it.
+func MergeTag(db *sqlx.DB, userId string, tagId string, intoTagId string) error {
+	if tagId == intoTagId {
+		return errors.New("a tag can't be merged into itself")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var valid bool
+	err = tx.Get(
+		&valid,
+		`SELECT EXISTS (SELECT 1 FROM tags WHERE id::text = $3 AND user_id = $1)
+		 AND $3 NOT IN (SELECT id::text FROM `+tagSubtreeSql("id::text = $2")+` AS subtree)`,
+		userId,
+		tagId,
+		intoTagId,
+	)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("a tag can only be merged into another tag that isn't nested under it")
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO feed_tags (feed_id, tag_id)
+		 SELECT ft.feed_id, CAST($3 AS uuid) FROM feed_tags ft
+		 INNER JOIN tags t ON (ft.tag_id = t.id AND t.user_id = $1)
+		 WHERE t.id::text = $2
+		 ON CONFLICT DO NOTHING`,
+		userId,
+		tagId,
+		intoTagId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tags SET parent_id = CAST($3 AS uuid)
+		 WHERE parent_id::text = $2 AND user_id = $1`,
+		userId,
+		tagId,
+		intoTagId,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`DELETE FROM tags WHERE id::text = $2 AND user_id = $1`,
+		userId,
+		tagId,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// tagSubtreeSql selects the ids of the tags of user $1 matching roots, and
+// of every tag nested under them.
+func tagSubtreeSql(roots string) string {
+	return `(
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM tags WHERE user_id = $1 AND (` + roots + `)
+			UNION
+			SELECT child.id FROM tags child INNER JOIN subtree ON (child.parent_id = subtree.id)
+		)
+		SELECT id FROM subtree
+	)`
+}
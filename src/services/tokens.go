@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+)
+
+// API token service types and functions
+
+// ApiToken lets a non-browser client act as the user. Read-only tokens may
+// only read.
+type ApiToken struct {
+	Id         string  `json:"id"`
+	UserId     string  `db:"user_id" json:"userId"`
+	Name       string  `json:"name"`
+	ReadOnly   bool    `db:"read_only" json:"readOnly"`
+	CreatedAt  string  `db:"created_at" json:"createdAt"`
+	LastUsedAt *string `db:"last_used_at" json:"lastUsedAt"`
+}
+
+// CreateApiToken stores a new token and returns it together with the signed
+// JWT the client sends. The JWT can't be recovered later.
+func CreateApiToken(db *sqlx.DB, secret []byte, userId string, name string, readOnly bool) (ApiToken, string, error) {
+	token := ApiToken{}
+	if len(secret) == 0 {
+		return token, "", errors.New("API tokens need JWT_SECRET to be set")
+	}
+	if strings.TrimSpace(name) == "" {
+		return token, "", errors.New("a token needs a name")
+	}
+
+	err := db.Get(
+		&token,
+		`INSERT INTO api_tokens (user_id, name, read_only) VALUES ($1, $2, $3) RETURNING *`,
+		userId,
+		strings.TrimSpace(name),
+		readOnly,
+	)
+	if err != nil {
+		return token, "", err
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:       token.Id,
+		Subject:  userId,
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}).SignedString(secret)
+	if err != nil {
+		return token, "", err
+	}
+
+	return token, signed, nil
+}
+
+func GetUserApiTokens(db *sqlx.DB, userId string) ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	err := db.Select(
+		&tokens,
+		`SELECT * FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`,
+		userId,
+	)
+
+	if err != nil {
+		return tokens, err
+	}
+
+	return tokens, nil
+}
+
+// UseApiToken looks up the token a verified JWT names and records that it
+// was used. It returns sql.ErrNoRows for revoked tokens.
+func UseApiToken(db *sqlx.DB, userId string, tokenId string) (ApiToken, error) {
+	token := ApiToken{}
+	err := db.Get(
+		&token,
+		`UPDATE api_tokens SET last_used_at = NOW()
+		 WHERE id::text = $2 AND user_id::text = $1
+		 RETURNING *`,
+		userId,
+		tokenId,
+	)
+
+	if err != nil {
+		return token, err
+	}
+
+	return token, nil
+}
+
+func RevokeApiToken(db *sqlx.DB, userId string, tokenId string) error {
+	_, err := db.Exec(
+		`DELETE FROM api_tokens WHERE id::text = $2 AND user_id = $1`,
+		userId,
+		tokenId,
+	)
+
+	return err
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// NormalizeFeedUrl brings a feed URL into a canonical form so that the same
+// feed typed in slightly different ways ends up as a single feeds row:
+// https is assumed when no scheme is given, the scheme and host are lower
+// cased and default ports and fragments are dropped. The path and query are
+// left exactly as given, as servers may tell apart what looks the same, such
+// as %2F and /. A trailing slash is kept too, as some servers only answer on
+// one of the two forms; feedUrlVariants matches the other.
+func NormalizeFeedUrl(rawUrl string) (string, error) {
+	rawUrl = strings.TrimSpace(rawUrl)
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "https://" + rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("feed URL must use http or https")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", errors.New("feed URL has no host")
+	}
+	// Hostname strips the brackets off IPv6 addresses
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	u.Host = host
+	if port != "" {
+		u.Host = host + ":" + port
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String(), nil
+}
+
+// feedUrlVariants lists the spellings of a normalized feed URL that lead to
+// the same feed: over http and https, with and without a trailing slash.
+func feedUrlVariants(feedUrl string) []string {
+	u, err := url.Parse(feedUrl)
+	if err != nil {
+		return []string{feedUrl}
+	}
+
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	variants := []string{}
+	for _, scheme := range []string{"https", "http"} {
+		for _, variantPath := range []string{path, path + "/"} {
+			variant := *u
+			variant.Scheme = scheme
+			variant.RawPath = variantPath
+			variant.Path, err = url.PathUnescape(variantPath)
+			if err != nil {
+				return []string{feedUrl}
+			}
+			variants = append(variants, variant.String())
+		}
+	}
+
+	return variants
+}
+
+// feedUrlKey is the same for all variants of a normalized feed URL.
+func feedUrlKey(feedUrl string) string {
+	return strings.ToLower(feedUrlVariants(feedUrl)[0])
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeFeedUrl(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"example.com/feed", "https://example.com/feed", false},
+		{"  HTTPS://Example.COM/Feed  ", "https://example.com/Feed", false},
+		{"https://example.com:443/feed", "https://example.com/feed", false},
+		{"http://example.com:80/feed", "http://example.com/feed", false},
+		{"http://example.com:8080/feed", "http://example.com:8080/feed", false},
+		{"https://example.com", "https://example.com/", false},
+		{"https://example.com/feed/", "https://example.com/feed/", false},
+		{"https://example.com/feed#top", "https://example.com/feed", false},
+		{"https://example.com/a%2Fb", "https://example.com/a%2Fb", false},
+		{"https://example.com/feed?b=2&a=1", "https://example.com/feed?b=2&a=1", false},
+		{"https://example.com/feed?q=a+b%20c", "https://example.com/feed?q=a+b%20c", false},
+		{"http://[::1]:8080/feed", "http://[::1]:8080/feed", false},
+		{"https://[2001:DB8::1]:443/feed", "https://[2001:db8::1]/feed", false},
+		{"ftp://example.com/feed", "", true},
+		{"https:///feed", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := NormalizeFeedUrl(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("NormalizeFeedUrl(%q) = %q, want an error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NormalizeFeedUrl(%q) failed: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("NormalizeFeedUrl(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFeedUrlVariants(t *testing.T) {
+	got := feedUrlVariants("https://example.com/a%2Fb/?x=1")
+	want := []string{
+		"https://example.com/a%2Fb?x=1",
+		"https://example.com/a%2Fb/?x=1",
+		"http://example.com/a%2Fb?x=1",
+		"http://example.com/a%2Fb/?x=1",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("feedUrlVariants = %q, want %q", got, want)
+	}
+
+	if feedUrlKey("http://example.com/feed/") != feedUrlKey("https://example.com/feed") {
+		t.Error("variants of a URL should share a key")
+	}
+}
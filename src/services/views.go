@@ -0,0 +1,475 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// View service types and functions
+
+// View is a saved query that works as a timeline of its own, e.g.
+// `unread AND tag:golang AND title:release AND within:7d`.
+type View struct {
+	Id        string `json:"id"`
+	UserId    string `db:"user_id" json:"userId"`
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	CreatedAt string `db:"created_at" json:"createdAt"`
+}
+
+type ViewWithUnread struct {
+	View
+	UnreadCount int `db:"unread_count" json:"unreadCount"`
+}
+
+func GetUserViews(db *sqlx.DB, userId string) ([]View, error) {
+	views := []View{}
+	err := db.Select(
+		&views,
+		"SELECT * FROM views WHERE user_id = $1 ORDER BY name",
+		userId,
+	)
+
+	if err != nil {
+		return views, err
+	}
+
+	return views, nil
+}
+
+// GetUserViewsWithUnread counts the unread items of every view, all in a
+// single pass over the user's unread items. A view whose query no longer
+// parses is listed with no unread items.
+func GetUserViewsWithUnread(db *sqlx.DB, userId string) ([]ViewWithUnread, error) {
+	views, err := GetUserViews(db, userId)
+	if err != nil {
+		return []ViewWithUnread{}, err
+	}
+
+	result := make([]ViewWithUnread, len(views))
+	counts := []string{}
+	targets := []interface{}{}
+	args := []interface{}{userId, true}
+
+	for i, view := range views {
+		result[i].View = view
+
+		query, err := ParseViewQuery(view.Query)
+		if err != nil {
+			continue
+		}
+
+		extraSql, extraArgs := ContentFilter{View: query}.extraSql(len(args) + 1)
+		args = append(args, extraArgs...)
+		counts = append(counts, "COUNT(*) FILTER (WHERE "+extraSql+")")
+		targets = append(targets, &result[i].UnreadCount)
+	}
+
+	if len(counts) == 0 {
+		return result, nil
+	}
+
+	err = db.QueryRowx(
+		`SELECT `+strings.Join(counts, ", ")+`
+		 	FROM feed_content fc
+		 INNER JOIN user_feeds uf ON (uf.feed_id = fc.feed_id)
+		 WHERE `+contentFilterSql,
+		args...,
+	).Scan(targets...)
+
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func GetView(db *sqlx.DB, userId string, viewId string) (View, error) {
+	view := View{}
+	err := db.Get(
+		&view,
+		"SELECT * FROM views WHERE id::text = $1 AND user_id = $2",
+		viewId,
+		userId,
+	)
+
+	if err != nil {
+		return view, err
+	}
+
+	return view, nil
+}
+
+func CreateView(db *sqlx.DB, userId string, name string, query string) (View, error) {
+	view := View{}
+
+	if _, err := ParseViewQuery(query); err != nil {
+		return view, err
+	}
+
+	err := db.Get(
+		&view,
+		"INSERT INTO views (user_id, name, query) VALUES ($1, $2, $3) RETURNING *",
+		userId,
+		name,
+		query,
+	)
+
+	if err != nil {
+		return view, err
+	}
+
+	return view, nil
+}
+
+func UpdateView(db *sqlx.DB, userId string, viewId string, name string, query string) error {
+	if _, err := ParseViewQuery(query); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		"UPDATE views SET name = $1, query = $2 WHERE id::text = $3 AND user_id = $4",
+		name,
+		query,
+		viewId,
+		userId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("view not found")
+	}
+
+	return nil
+}
+
+func DeleteView(db *sqlx.DB, userId string, viewId string) error {
+	_, err := db.Exec(
+		"DELETE FROM views WHERE id::text = $1 AND user_id = $2",
+		viewId,
+		userId,
+	)
+
+	return err
+}
+
+// ViewQuery is a parsed view query. The language is a list of terms joined
+// with AND (the default), OR and NOT, grouped with parentheses:
+//
+//	unread, read, starred     the item's state for the user
+//	tag:NAME                  the item's feed has this tag, or one nested
+//	                          under it
+//	untagged                  the item's feed has no tag at all
+//	feed:TEXT                 the feed title contains TEXT
+//	title:TEXT                the item title contains TEXT
+//	author:TEXT               the item author contains TEXT
+//	within:7d, older:30d      published within or before the last 7 days,
+//	                          in h(ours), d(ays) or w(eeks)
+//	TEXT                      full-text match on title, summary and content
+//
+// Values with spaces are quoted, e.g. title:"release notes".
+type ViewQuery struct {
+	// One of "and", "or", "not" or "term"
+	op       string
+	children []*ViewQuery
+	field    string
+	value    string
+}
+
+// ParseViewQuery parses a view query, reporting the first problem found.
+func ParseViewQuery(query string) (*ViewQuery, error) {
+	tokens, err := tokenizeViewQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("the query is empty")
+	}
+
+	p := &viewQueryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return node, nil
+}
+
+// sql compiles the query into a condition on feed_content fc, with $1 being
+// the user id and the query's own arguments numbered from firstArg.
+func (q *ViewQuery) sql(firstArg int) (string, []interface{}) {
+	args := []interface{}{}
+	return q.compile(firstArg, &args), args
+}
+
+func (q *ViewQuery) compile(firstArg int, args *[]interface{}) string {
+	param := func(value interface{}) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(firstArg+len(*args)-1)
+	}
+
+	switch q.op {
+	case "and", "or":
+		parts := []string{}
+		for _, child := range q.children {
+			parts = append(parts, child.compile(firstArg, args))
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(q.op)+" ") + ")"
+	case "not":
+		return "NOT " + q.children[0].compile(firstArg, args)
+	}
+
+	switch q.field {
+	case "unread":
+		return "NOT EXISTS (SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id)"
+	case "read":
+		return "EXISTS (SELECT 1 FROM user_item_reads r WHERE r.user_id = $1 AND r.content_id = fc.id)"
+	case "starred":
+		return "EXISTS (SELECT 1 FROM starred_items s WHERE s.user_id = $1 AND s.content_id = fc.id)"
+	case "untagged":
+		return `NOT EXISTS (
+			SELECT 1 FROM feed_tags ft
+			INNER JOIN tags t ON (ft.tag_id = t.id AND t.user_id = $1)
+			WHERE ft.feed_id = fc.feed_id
+		)`
+	case "tag":
+		return `EXISTS (
+			SELECT 1 FROM feed_tags ft
+			WHERE ft.feed_id = fc.feed_id AND ft.tag_id IN ` + tagSubtreeSql("name = "+param(q.value)) + `
+		)`
+	case "feed":
+		return "EXISTS (SELECT 1 FROM feeds f WHERE f.id = fc.feed_id AND " + feedTitleSql + " ILIKE " + param(likePattern(q.value)) + ")"
+	case "title":
+		return "fc.title ILIKE " + param(likePattern(q.value))
+	case "author":
+		return "fc.author ILIKE " + param(likePattern(q.value))
+	case "within":
+		return "COALESCE(fc.published_at, fc.created_at) >= NOW() - CAST(" + param(q.value) + " AS interval)"
+	case "older":
+		return "COALESCE(fc.published_at, fc.created_at) < NOW() - CAST(" + param(q.value) + " AS interval)"
+	}
+
+	return "fc.search_vector @@ plainto_tsquery('english', " + param(q.value) + ")"
+}
+
+func likePattern(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(value) + "%"
+}
+
+type viewQueryToken struct {
+	text string
+	// Quoted tokens are always values, never keywords or parentheses
+	quoted bool
+}
+
+func tokenizeViewQuery(query string) ([]viewQueryToken, error) {
+	tokens := []viewQueryToken{}
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, viewQueryToken{text: string(r)})
+			i++
+		default:
+			var text strings.Builder
+			quoted := false
+
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				if runes[i] != '"' {
+					text.WriteRune(runes[i])
+					i++
+					continue
+				}
+
+				end := i + 1
+				for end < len(runes) && runes[end] != '"' {
+					end++
+				}
+				if end == len(runes) {
+					return nil, errors.New("missing closing quote")
+				}
+
+				text.WriteString(string(runes[i+1 : end]))
+				quoted = true
+				i = end + 1
+			}
+
+			tokens = append(tokens, viewQueryToken{text: text.String(), quoted: quoted})
+		}
+	}
+
+	return tokens, nil
+}
+
+type viewQueryParser struct {
+	tokens []viewQueryToken
+	pos    int
+}
+
+// keyword reports whether the next token is the given unquoted keyword.
+func (p *viewQueryParser) keyword(word string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+
+	return strings.EqualFold(p.tokens[p.pos].text, word)
+}
+
+func (p *viewQueryParser) parseOr() (*ViewQuery, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*ViewQuery{node}
+	for p.keyword("OR") {
+		p.pos++
+
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return &ViewQuery{op: "or", children: children}, nil
+}
+
+func (p *viewQueryParser) parseAnd() (*ViewQuery, error) {
+	node, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*ViewQuery{node}
+	for p.pos < len(p.tokens) && !p.keyword("OR") && !p.keyword(")") {
+		if p.keyword("AND") {
+			p.pos++
+		}
+
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return &ViewQuery{op: "and", children: children}, nil
+}
+
+func (p *viewQueryParser) parseNot() (*ViewQuery, error) {
+	if p.keyword("NOT") {
+		p.pos++
+
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &ViewQuery{op: "not", children: []*ViewQuery{node}}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *viewQueryParser) parsePrimary() (*ViewQuery, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("the query ends too early")
+	}
+
+	if p.keyword("(") {
+		p.pos++
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+
+		return node, nil
+	}
+
+	token := p.tokens[p.pos]
+	if !token.quoted && (token.text == ")" || strings.EqualFold(token.text, "AND") || strings.EqualFold(token.text, "OR")) {
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+	p.pos++
+
+	return parseViewTerm(token)
+}
+
+func parseViewTerm(token viewQueryToken) (*ViewQuery, error) {
+	switch strings.ToLower(token.text) {
+	case "unread", "read", "starred", "untagged":
+		if !token.quoted {
+			return &ViewQuery{op: "term", field: strings.ToLower(token.text)}, nil
+		}
+	}
+
+	field, value, found := strings.Cut(token.text, ":")
+	if !found {
+		return &ViewQuery{op: "term", field: "text", value: token.text}, nil
+	}
+
+	field = strings.ToLower(field)
+	if value == "" {
+		return nil, fmt.Errorf("%s: needs a value", field)
+	}
+
+	switch field {
+	case "tag", "feed", "title", "author", "text":
+		return &ViewQuery{op: "term", field: field, value: value}, nil
+	case "within", "older":
+		interval, err := parseViewInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		return &ViewQuery{op: "term", field: field, value: interval}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %q", field)
+}
+
+// parseViewInterval turns 12h, 7d or 2w into a PostgreSQL interval.
+func parseViewInterval(value string) (string, error) {
+	units := map[string]string{"h": "hours", "d": "days", "w": "weeks"}
+
+	unit, ok := units[strings.ToLower(value[len(value)-1:])]
+	amount, err := strconv.Atoi(value[:len(value)-1])
+	if !ok || err != nil || amount <= 0 {
+		return "", fmt.Errorf("%q is not a period like 12h, 7d or 2w", value)
+	}
+
+	return strconv.Itoa(amount) + " " + unit, nil
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+// describeViewQuery renders a parsed query as an s-expression, e.g.
+// (or (and unread tag:go) starred).
+func describeViewQuery(q *ViewQuery) string {
+	switch q.op {
+	case "and", "or", "not":
+		parts := []string{q.op}
+		for _, child := range q.children {
+			parts = append(parts, describeViewQuery(child))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+
+	if q.value == "" {
+		return q.field
+	}
+
+	return q.field + ":" + q.value
+}
+
+func TestParseViewQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"unread", "unread"},
+		{"UNREAD", "unread"},
+		{"golang", "text:golang"},
+		{"tag:go", "tag:go"},
+		{"Tag:Go", "tag:Go"},
+
+		// AND is implied and binds tighter than OR
+		{"unread tag:go", "(and unread tag:go)"},
+		{"unread AND tag:go", "(and unread tag:go)"},
+		{"unread tag:go OR starred", "(or (and unread tag:go) starred)"},
+		{"starred OR unread tag:go", "(or starred (and unread tag:go))"},
+		{"a OR b OR c", "(or text:a text:b text:c)"},
+		{"a or b and c", "(or text:a (and text:b text:c))"},
+
+		// NOT binds tighter than AND
+		{"NOT read tag:go", "(and (not read) tag:go)"},
+		{"NOT NOT read", "(not (not read))"},
+
+		// Parentheses override precedence
+		{"unread (tag:go OR tag:rust)", "(and unread (or tag:go tag:rust))"},
+		{"NOT (read OR starred)", "(not (or read starred))"},
+		{"((unread))", "unread"},
+		{"(a b)c", "(and (and text:a text:b) text:c)"},
+
+		// Quoting
+		{`title:"release notes"`, "title:release notes"},
+		{`"release notes"`, "text:release notes"},
+		{`feed:"Go Blog" unread`, "(and feed:Go Blog unread)"},
+		{`"OR"`, "text:OR"},
+		{`"unread"`, "text:unread"},
+		{`"(a)"`, "text:(a)"},
+		{`a"b c"d`, "text:ab cd"},
+
+		// Periods become PostgreSQL intervals
+		{"within:12h", "within:12 hours"},
+		{"within:7d", "within:7 days"},
+		{"older:2W", "older:2 weeks"},
+	}
+
+	for _, test := range tests {
+		query, err := ParseViewQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseViewQuery(%q) failed: %v", test.query, err)
+			continue
+		}
+
+		if got := describeViewQuery(query); got != test.want {
+			t.Errorf("ParseViewQuery(%q) = %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseViewQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "the query is empty"},
+		{"   ", "the query is empty"},
+		{`title:"release notes`, "missing closing quote"},
+		{"(unread", "missing closing parenthesis"},
+		{"unread)", `unexpected ")"`},
+		{")", `unexpected ")"`},
+		{"OR unread", `unexpected "OR"`},
+		{"unread AND", "the query ends too early"},
+		{"unread OR", "the query ends too early"},
+		{"NOT", "the query ends too early"},
+		{"()", `unexpected ")"`},
+		{"tag:", "tag: needs a value"},
+		{"colour:red", `unknown field "colour"`},
+		{"within:7", `within: "7" is not a period like 12h, 7d or 2w`},
+		{"older:0d", `older: "0d" is not a period like 12h, 7d or 2w`},
+		{"within:3y", `within: "3y" is not a period like 12h, 7d or 2w`},
+	}
+
+	for _, test := range tests {
+		query, err := ParseViewQuery(test.query)
+		if err == nil {
+			t.Errorf("ParseViewQuery(%q) = %s, want error %q", test.query, describeViewQuery(query), test.want)
+			continue
+		}
+
+		if err.Error() != test.want {
+			t.Errorf("ParseViewQuery(%q) error = %q, want %q", test.query, err, test.want)
+		}
+	}
+}
+
+func TestViewQuerySql(t *testing.T) {
+	query, err := ParseViewQuery(`tag:go OR title:"50%_off" NOT within:7d`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql, args := query.sql(4)
+
+	for _, placeholder := range []string{"$4", "$5", "$6"} {
+		if !strings.Contains(sql, placeholder) {
+			t.Errorf("sql doesn't use %s: %s", placeholder, sql)
+		}
+	}
+	if strings.Contains(sql, "$7") {
+		t.Errorf("sql uses more placeholders than it has arguments: %s", sql)
+	}
+
+	want := []interface{}{"go", `%50\%\_off%`, "7 days"}
+	if len(args) != len(want) {
+		t.Fatalf("args = %q, want %q", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("args[%d] = %q, want %q", i, args[i], want[i])
+		}
+	}
+}